@@ -0,0 +1,98 @@
+package main
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/monsmain/endpoint-scanner/scanner"
+)
+
+func endpointKey(endpoint, protocol string) string {
+	return endpoint + "/" + protocol
+}
+
+// blacklist counts how often endpoints that opened in an earlier -watch
+// cycle fail a later probe, and drops those that failed more than
+// threshold times from the results. A nil blacklist drops nothing.
+type blacklist struct {
+	threshold int
+	path      string // cache file the counts persist in, if any
+
+	mu       sync.Mutex
+	opened   map[string]bool
+	failures map[string]int
+}
+
+// newBlacklist starts from the failure counts saved in the cache at path,
+// if any.
+func newBlacklist(threshold int, path string) (*blacklist, error) {
+	b := &blacklist{threshold: threshold, path: path, opened: make(map[string]bool), failures: make(map[string]int)}
+	if path == "" {
+		return b, nil
+	}
+	cache, err := readCache(path)
+	if err != nil {
+		return b, err
+	}
+	for key, n := range cache.Failures {
+		b.opened[key] = true
+		b.failures[key] = n
+	}
+	return b, nil
+}
+
+// failed is an Options.OnFailure callback.
+func (b *blacklist) failed(endpoint, protocol string, _ error) {
+	key := endpointKey(endpoint, protocol)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.opened[key] {
+		b.failures[key]++
+	}
+}
+
+// admit records result as opened and reports whether it is not
+// blacklisted.
+func (b *blacklist) admit(result scanner.EndpointResult) bool {
+	if b == nil {
+		return true
+	}
+	key := endpointKey(result.Target, result.Protocol)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.opened[key] = true
+	return b.failures[key] <= b.threshold
+}
+
+// listed returns the blacklisted endpoints, sorted.
+func (b *blacklist) listed() []string {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var keys []string
+	for key, n := range b.failures {
+		if n > b.threshold {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// save writes the failure counts to the cache file, if there is one.
+func (b *blacklist) save() error {
+	if b == nil || b.path == "" {
+		return nil
+	}
+	b.mu.Lock()
+	failures := make(map[string]int, len(b.failures))
+	for key, n := range b.failures {
+		if n > 0 {
+			failures[key] = n
+		}
+	}
+	b.mu.Unlock()
+	return saveFailures(b.path, failures)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"net/url"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/monsmain/endpoint-scanner/scanner"
+)
+
+// bundleMeta is the metadata.json of a -bundle: enough to rerun the scan.
+type bundleMeta struct {
+	Timestamp time.Time         `json:"timestamp"`
+	OS        string            `json:"os"`
+	Arch      string            `json:"arch"`
+	GoVersion string            `json:"go_version"`
+	Args      []string          `json:"args"`
+	Flags     map[string]string `json:"flags"`
+}
+
+func newBundleMeta(fs *flag.FlagSet) bundleMeta {
+	meta := bundleMeta{
+		Timestamp: time.Now().UTC(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		GoVersion: runtime.Version(),
+		Args:      redactArgs(os.Args[1:]),
+		Flags:     make(map[string]string),
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		meta.Flags[f.Name] = f.Value.String()
+		if f.Name == "proxy" {
+			meta.Flags[f.Name] = redactURL(meta.Flags[f.Name])
+		}
+	})
+	return meta
+}
+
+// redactArgs masks the password of a -proxy URL in args, whether given as
+// -proxy=URL or as -proxy URL.
+func redactArgs(args []string) []string {
+	args = slices.Clone(args)
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if name != "proxy" {
+			continue
+		}
+		if hasValue {
+			args[i] = strings.TrimSuffix(arg, value) + redactURL(value)
+		} else if i+1 < len(args) {
+			args[i+1] = redactURL(args[i+1])
+		}
+	}
+	return args
+}
+
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	return u.Redacted()
+}
+
+// writeBundle writes a zip to path with the results as results.ndjson and
+// results.csv, the debug log of the run as scan.log, and metadata.json.
+func writeBundle(path string, results []scanner.EndpointResult, log []byte, meta bundleMeta) error {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	w, err := zw.Create("results.ndjson")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	for _, result := range results {
+		if err := writeJSONLine(enc, result, "", 0); err != nil {
+			return err
+		}
+	}
+
+	if w, err = zw.Create("results.csv"); err != nil {
+		return err
+	}
+	writer := csv.NewWriter(w)
+	writer.Write(csvHeader)
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	if err := writeCSV(w, results); err != nil {
+		return err
+	}
+
+	if w, err = zw.Create("scan.log"); err != nil {
+		return err
+	}
+	if _, err := w.Write(log); err != nil {
+		return err
+	}
+
+	if w, err = zw.Create("metadata.json"); err != nil {
+		return err
+	}
+	enc = json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(meta); err != nil {
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return writeAtomic(path, buf.Bytes())
+}
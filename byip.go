@@ -0,0 +1,73 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/monsmain/endpoint-scanner/scanner"
+)
+
+// resultsByIP groups results by IP, each group sorted by connect latency
+// with open|filtered ports last.
+func resultsByIP(results []scanner.EndpointResult) map[string][]scanner.EndpointResult {
+	groups := make(map[string][]scanner.EndpointResult)
+	for _, result := range results {
+		groups[result.Ping.IP] = append(groups[result.Ping.IP], result)
+	}
+	for _, group := range groups {
+		slices.SortStableFunc(group, func(a, b scanner.EndpointResult) int {
+			if fa, fb := a.State == scanner.StateOpenFiltered, b.State == scanner.StateOpenFiltered; fa != fb {
+				if fa {
+					return 1
+				}
+				return -1
+			}
+			return cmp.Compare(a.Latency, b.Latency)
+		})
+	}
+	return groups
+}
+
+// printByIP prints the first top IPs of groups (all with top 0) by real
+// ping, IPs that were not pinged last, with their open ports underneath.
+// annotate is called once with the endpoints of the printed IPs.
+func printByIP(groups map[string][]scanner.EndpointResult, top int, annotate func([]scanner.EndpointResult)) {
+	ips := make([]string, 0, len(groups))
+	for ip := range groups {
+		ips = append(ips, ip)
+	}
+	slices.SortFunc(ips, func(a, b string) int {
+		rttA, rttB := groups[a][0].Ping.RTT, groups[b][0].Ping.RTT
+		if (rttA == 0) != (rttB == 0) {
+			return cmp.Compare(rttB, rttA)
+		}
+		return cmp.Or(cmp.Compare(rttA, rttB), strings.Compare(a, b))
+	})
+	if top > 0 && top < len(ips) {
+		ips = ips[:top]
+	}
+	var shown []scanner.EndpointResult
+	for _, ip := range ips {
+		shown = append(shown, groups[ip]...)
+	}
+	annotate(shown)
+
+	if top == 0 {
+		fmt.Println("\n--- All IPs by Real Ping ---")
+	} else {
+		fmt.Printf("\n--- Top %d IPs by Real Ping ---\n", top)
+	}
+	for i, ip := range ips {
+		group := shown[:len(groups[ip])]
+		shown = shown[len(group):]
+		fmt.Printf("%d. %s (Real Ping: %s)\n", i+1, ip, formatPing(group[0].Ping))
+		for _, result := range group {
+			_, port, _ := net.SplitHostPort(result.Endpoint)
+			line := fmt.Sprintf("   %s %-5s Latency: %.2f ms%s", protocolLabel(result.Protocol), port, float64(result.Latency.Nanoseconds())/1e6, formatDetails(result))
+			fmt.Println(colors.byLatency(line, result.Latency))
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/monsmain/endpoint-scanner/scanner"
+)
+
+type cacheEntry struct {
+	IP    string    `json:"ip"`
+	RTTMs float64   `json:"rtt_ms"`
+	Seen  time.Time `json:"seen"`
+}
+
+type cacheFile struct {
+	IPs []cacheEntry `json:"ips"`
+	// Failures counts the -watch failures of endpoints that opened before,
+	// keyed by endpointKey.
+	Failures map[string]int `json:"failures,omitempty"`
+}
+
+// readCache reads a cache file, also accepting the bare array of IP
+// entries older versions wrote. A missing file is not an error.
+func readCache(path string) (cacheFile, error) {
+	var cache cacheFile
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cache, nil
+	}
+	if err != nil {
+		return cache, err
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(data, &cache.IPs)
+	} else {
+		err = json.Unmarshal(data, &cache)
+	}
+	return cache, err
+}
+
+func writeCache(path string, cache cacheFile) error {
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeAtomic(path, append(data, '\n'))
+}
+
+// loadCache returns the cached IPs seen within ttl, fastest first. A missing
+// file is not an error.
+func loadCache(path string, ttl time.Duration) ([]string, error) {
+	cache, err := readCache(path)
+	if err != nil {
+		return nil, err
+	}
+	entries := cache.IPs
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].RTTMs < entries[j].RTTMs
+	})
+	var ips []string
+	for _, entry := range entries {
+		if ttl > 0 && time.Since(entry.Seen) > ttl {
+			continue
+		}
+		ips = append(ips, entry.IP)
+	}
+	return ips, nil
+}
+
+// saveCache replaces the cached IPs with the ones behind results, keeping
+// the failure counts.
+func saveCache(path string, results []scanner.EndpointResult) error {
+	cache, _ := readCache(path)
+	cache.IPs = nil
+	now := time.Now().UTC()
+	seen := make(map[string]bool)
+	for _, result := range results {
+		if seen[result.Ping.IP] {
+			continue
+		}
+		seen[result.Ping.IP] = true
+		cache.IPs = append(cache.IPs, cacheEntry{
+			IP:    result.Ping.IP,
+			RTTMs: float64(result.Ping.RTT.Nanoseconds()) / 1e6,
+			Seen:  now,
+		})
+	}
+	return writeCache(path, cache)
+}
+
+// saveFailures replaces the cached failure counts, keeping the IPs.
+func saveFailures(path string, failures map[string]int) error {
+	cache, err := readCache(path)
+	if err != nil {
+		return err
+	}
+	cache.Failures = failures
+	return writeCache(path, cache)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/monsmain/endpoint-scanner/scanner"
+)
+
+// runCheck probes a single ip:port for -check and returns the exit code:
+// 0 if any protocol answered, 1 if none did (an open|filtered UDP port
+// does not count) and 2 for a malformed endpoint.
+// pingSkippedBy names the flag that disabled the ping, if any.
+func runCheck(ctx context.Context, s *scanner.Scanner, endpoint string, pingSkippedBy string) int {
+	host, portStr, err := net.SplitHostPort(endpoint)
+	ip := net.ParseIP(host)
+	port, portErr := strconv.Atoi(portStr)
+	if err != nil || ip == nil || portErr != nil || port < 1 || port > 65535 {
+		fmt.Fprintf(os.Stderr, "Invalid -check %q: must be ip:port\n", endpoint)
+		return 2
+	}
+
+	fmt.Printf("Checking %s...\n", net.JoinHostPort(ip.String(), portStr))
+	check := s.Check(ctx, ip.String(), port)
+	switch {
+	case pingSkippedBy != "":
+		fmt.Printf("Real Ping: skipped with %s\n", pingSkippedBy)
+	case check.PingErr != nil:
+		fmt.Printf("Real Ping: no reply (%v)\n", check.PingErr)
+	default:
+		fmt.Printf("Real Ping: %s\n", formatPing(check.Ping))
+	}
+	for _, result := range check.Endpoints {
+		fmt.Printf("%s %s: open (Latency: %.2f ms%s)\n", strings.ToUpper(result.Protocol), result.Endpoint,
+			float64(result.Latency.Nanoseconds())/1e6, formatDetails(result))
+	}
+	for _, protocol := range []string{"tcp", "udp"} {
+		if err, ok := check.Errors[protocol]; ok {
+			fmt.Printf("%s %s: unreachable (%v)\n", strings.ToUpper(protocol), net.JoinHostPort(ip.String(), portStr), err)
+		}
+	}
+	if len(answered(check.Endpoints)) == 0 {
+		return 1
+	}
+	return 0
+}
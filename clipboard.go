@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+var errNoClipboard = errors.New("no clipboard tool found (termux-clipboard-set, pbcopy, wl-copy, xclip or xsel)")
+
+// clipboardCommands lists the clipboard tools to try on this platform, in
+// order of preference.
+func clipboardCommands() [][]string {
+	commands := [][]string{{"termux-clipboard-set"}}
+	switch runtime.GOOS {
+	case "darwin":
+		commands = append(commands, []string{"pbcopy"})
+	case "windows":
+		commands = append(commands, []string{"clip"})
+	default:
+		if os.Getenv("WAYLAND_DISPLAY") != "" {
+			commands = append(commands, []string{"wl-copy"})
+		}
+		commands = append(commands, []string{"xclip", "-selection", "clipboard"}, []string{"xsel", "--clipboard", "--input"})
+	}
+	return commands
+}
+
+// copyToClipboard pipes s into the first clipboard tool found on PATH.
+func copyToClipboard(s string) error {
+	for _, args := range clipboardCommands() {
+		path, err := exec.LookPath(args[0])
+		if err != nil {
+			continue
+		}
+		cmd := exec.Command(path, args[1:]...)
+		cmd.Stdin = strings.NewReader(s)
+		return cmd.Run()
+	}
+	return errNoClipboard
+}
@@ -0,0 +1,44 @@
+package main
+
+import "time"
+
+const (
+	ansiReset  = "\x1b[0m"
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+)
+
+// colorizer wraps report lines in ANSI colors. The zero value leaves them
+// plain; main enables it when stdout is a terminal and -no-color is unset.
+type colorizer struct {
+	enabled bool
+	good    time.Duration
+	bad     time.Duration
+}
+
+var colors colorizer
+
+func (c colorizer) wrap(code, s string) string {
+	if !c.enabled {
+		return s
+	}
+	return code + s + ansiReset
+}
+
+// best colors the best-endpoint lines.
+func (c colorizer) best(s string) string {
+	return c.wrap(ansiGreen, s)
+}
+
+// byLatency colors a line yellow once latency reaches the good threshold
+// and red once it reaches the bad one.
+func (c colorizer) byLatency(s string, latency time.Duration) string {
+	switch {
+	case latency >= c.bad:
+		return c.wrap(ansiRed, s)
+	case latency >= c.good:
+		return c.wrap(ansiYellow, s)
+	}
+	return s
+}
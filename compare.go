@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/monsmain/endpoint-scanner/scanner"
+)
+
+type comparison struct {
+	endpoint string
+	tcp, udp time.Duration
+}
+
+// compareProtocols joins TCP and UDP results on ip:port. Endpoints open on
+// both protocols come first, ordered by the slower of their two latencies;
+// the rest follow by their one latency. A zero latency means not open.
+func compareProtocols(tcpResults, udpResults []scanner.EndpointResult) []comparison {
+	byEndpoint := make(map[string]*comparison)
+	var rows []*comparison
+	row := func(endpoint string) *comparison {
+		if c, ok := byEndpoint[endpoint]; ok {
+			return c
+		}
+		c := &comparison{endpoint: endpoint}
+		byEndpoint[endpoint] = c
+		rows = append(rows, c)
+		return c
+	}
+	for _, result := range tcpResults {
+		row(result.Endpoint).tcp = result.Latency
+	}
+	for _, result := range udpResults {
+		row(result.Endpoint).udp = result.Latency
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		bothI := rows[i].tcp > 0 && rows[i].udp > 0
+		bothJ := rows[j].tcp > 0 && rows[j].udp > 0
+		if bothI != bothJ {
+			return bothI
+		}
+		return max(rows[i].tcp, rows[i].udp) < max(rows[j].tcp, rows[j].udp)
+	})
+	comparisons := make([]comparison, len(rows))
+	for i, c := range rows {
+		comparisons[i] = *c
+	}
+	return comparisons
+}
+
+func formatCompared(latency time.Duration) string {
+	if latency == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f ms", millis(latency))
+}
+
+// printComparison prints the -compare table of TCP and UDP latencies per
+// endpoint.
+func printComparison(tcpResults, udpResults []scanner.EndpointResult) {
+	fmt.Println("\n--- TCP vs UDP ---")
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ENDPOINT\tTCP\tUDP")
+	for _, c := range compareProtocols(tcpResults, udpResults) {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", c.endpoint, formatCompared(c.tcp), formatCompared(c.udp))
+	}
+	tw.Flush()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// loadConfig applies the JSON object in path to every flag not set on the
+// command line. Keys are flag names without the dash, e.g.
+//
+//	{"cidr": "162.159.192.0/24", "ports": [443, "8880-8890"], "tcp-timeout": "2s", "format": "table"}
+//
+// Arrays are joined with commas. Unknown keys and invalid values are all
+// reported at once.
+func loadConfig(fs *flag.FlagSet, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var settings map[string]any
+	dec := json.NewDecoder(file)
+	dec.UseNumber()
+	if err := dec.Decode(&settings); err != nil {
+		return err
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	var problems []string
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		if fs.Lookup(key) == nil || key == "config" {
+			problems = append(problems, fmt.Sprintf("unknown key %q", key))
+			continue
+		}
+		value, err := configValue(settings[key])
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("key %q: %v", key, err))
+			continue
+		}
+		if explicit[key] {
+			continue
+		}
+		if err := fs.Set(key, value); err != nil {
+			problems = append(problems, fmt.Sprintf("key %q: %v", key, err))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// configValue renders a JSON value in the form the flag would take it on
+// the command line.
+func configValue(value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []any:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			if _, ok := item.([]any); ok {
+				return "", errors.New("nested arrays are not supported")
+			}
+			part, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = part
+		}
+		return strings.Join(parts, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", value)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/monsmain/endpoint-scanner/scanner"
+)
+
+type failedProbe struct {
+	endpoint, protocol string
+	err                error
+}
+
+// failureLog collects the failed probes reported through
+// Options.OnFailure for -show-failures.
+type failureLog struct {
+	mu     sync.Mutex
+	probes []failedProbe
+}
+
+func (l *failureLog) add(endpoint, protocol string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.probes = append(l.probes, failedProbe{endpoint: endpoint, protocol: protocol, err: err})
+}
+
+// print lists every failed probe with its failure class and error, by
+// protocol and endpoint.
+func (l *failureLog) print() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Println("\n--- Failed Endpoints ---")
+	if len(l.probes) == 0 {
+		fmt.Println("No probe failed.")
+		return
+	}
+	slices.SortFunc(l.probes, func(a, b failedProbe) int {
+		return cmp.Or(cmp.Compare(a.protocol, b.protocol), cmp.Compare(a.endpoint, b.endpoint))
+	})
+	for _, probe := range l.probes {
+		fmt.Printf("%s %s: %s (%v)\n", protocolLabel(probe.protocol), probe.endpoint, scanner.ClassifyFailure(probe.err), probe.err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/monsmain/endpoint-scanner/scanner"
+)
+
+// familyPair is the first IPv4 and IPv6 address a -targets hostname
+// resolved to.
+type familyPair struct {
+	host   string
+	v4, v6 string
+}
+
+// dualStackHosts pairs up the hostnames in hosts that resolved to both an
+// IPv4 and an IPv6 address among ips, in the order they first appear.
+func dualStackHosts(ips []string, hosts map[string]string) []familyPair {
+	byHost := make(map[string]*familyPair)
+	var order []string
+	for _, ip := range ips {
+		host := hosts[ip]
+		if host == "" {
+			continue
+		}
+		pair, ok := byHost[host]
+		if !ok {
+			pair = &familyPair{host: host}
+			byHost[host] = pair
+			order = append(order, host)
+		}
+		if net.ParseIP(ip).To4() != nil {
+			if pair.v4 == "" {
+				pair.v4 = ip
+			}
+		} else if pair.v6 == "" {
+			pair.v6 = ip
+		}
+	}
+	var pairs []familyPair
+	for _, host := range order {
+		if pair := byHost[host]; pair.v4 != "" && pair.v6 != "" {
+			pairs = append(pairs, *pair)
+		}
+	}
+	return pairs
+}
+
+// runHappyEyeballs races IPv6 against IPv4 on every TCP port of each
+// dual-stack -targets hostname and prints the winners. It returns 0 if any
+// race was won and 1 otherwise.
+func runHappyEyeballs(ctx context.Context, s *scanner.Scanner, ips []string, hosts map[string]string) int {
+	pairs := dualStackHosts(ips, hosts)
+	if len(pairs) == 0 {
+		fmt.Fprintln(os.Stderr, "-happy-eyeballs: no -targets hostname resolved to both an IPv4 and an IPv6 address")
+		return 1
+	}
+	code := 1
+	for _, pair := range pairs {
+		for _, probe := range s.Plan([]string{pair.v4}) {
+			if probe.Protocol != "tcp" || ctx.Err() != nil {
+				continue
+			}
+			result, err := s.RaceFamilies(ctx, pair.v4, pair.v6, probe.Port)
+			if err != nil {
+				fmt.Printf("%s:%d: unreachable over both families (%v)\n", pair.host, probe.Port, err)
+				continue
+			}
+			code = 0
+			fmt.Printf("%s:%d: %s won via %s (Latency: %.2f ms)\n", pair.host, probe.Port, result.Family, result.Endpoint, millis(result.Latency))
+		}
+	}
+	return code
+}
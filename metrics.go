@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/monsmain/endpoint-scanner/scanner"
+)
+
+// watchMetrics holds the gauges served on -metrics-addr. Protocols without
+// an endpoint that answered in the last cycle report NaN.
+type watchMetrics struct {
+	bestLatency  map[string]prometheus.Gauge
+	bestLoss     map[string]prometheus.Gauge
+	responsiveIP prometheus.Gauge
+}
+
+func newWatchMetrics() (*watchMetrics, *prometheus.Registry) {
+	m := &watchMetrics{
+		bestLatency: make(map[string]prometheus.Gauge),
+		bestLoss:    make(map[string]prometheus.Gauge),
+		responsiveIP: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "scanner_responsive_ips",
+			Help: "IPs that answered ping in the last watch cycle.",
+		}),
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(m.responsiveIP)
+	for _, protocol := range []string{"tcp", "udp"} {
+		m.bestLatency[protocol] = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "scanner_best_" + protocol + "_latency_ms",
+			Help: "Connect latency of the best " + protocolLabel(protocol) + " endpoint in the last watch cycle.",
+		})
+		m.bestLoss[protocol] = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "scanner_best_" + protocol + "_loss_percent",
+			Help: "Ping packet loss of the best " + protocolLabel(protocol) + " endpoint in the last watch cycle.",
+		})
+		m.bestLatency[protocol].Set(math.NaN())
+		m.bestLoss[protocol].Set(math.NaN())
+		registry.MustRegister(m.bestLatency[protocol], m.bestLoss[protocol])
+	}
+	return m, registry
+}
+
+// serveMetrics starts serving /metrics on addr in the background.
+func serveMetrics(addr string, logger *slog.Logger) *watchMetrics {
+	m, registry := newWatchMetrics()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("metrics server stopped", "addr", addr, "err", err)
+		}
+	}()
+	return m
+}
+
+// update records the results of a finished cycle. byProto must already be
+// sorted best first.
+func (m *watchMetrics) update(byProto map[string][]scanner.EndpointResult, responsive int) {
+	if m == nil {
+		return
+	}
+	m.responsiveIP.Set(float64(responsive))
+	for protocol, latency := range m.bestLatency {
+		results := answered(byProto[protocol])
+		if len(results) == 0 {
+			latency.Set(math.NaN())
+			m.bestLoss[protocol].Set(math.NaN())
+			continue
+		}
+		latency.Set(float64(results[0].Latency.Nanoseconds()) / 1e6)
+		m.bestLoss[protocol].Set(results[0].Ping.Loss)
+	}
+}
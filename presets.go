@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"text/tabwriter"
+
+	"github.com/monsmain/endpoint-scanner/scanner"
+)
+
+// printPresets lists the built-in presets for -list-presets.
+func printPresets() {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PRESET\tIPV4 /24S\tIPV6 PREFIXES\tTCP PORTS\tUDP PORTS\tDESCRIPTION")
+	for _, name := range slices.Sorted(maps.Keys(scanner.Presets)) {
+		p := scanner.Presets[name]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\n", name, len(p.IPv4Subnets), len(p.IPv6Prefixes), len(p.TCPPorts), len(p.UDPPorts), p.Description)
+	}
+	tw.Flush()
+}
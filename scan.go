@@ -1,237 +1,1378 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
 	"math/rand"
 	"net"
-	"os/exec"
-	"regexp"
-	"sort"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
 	"strconv"
-	"sync"
+	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
+
+	"github.com/monsmain/endpoint-scanner/scanner"
 )
 
-type PingResult struct {
-	IP  string
-	RTT time.Duration
+// normalizePorts returns ports sorted with duplicates removed.
+func normalizePorts(ports []int) []int {
+	sorted := slices.Clone(ports)
+	slices.Sort(sorted)
+	return slices.Compact(sorted)
 }
 
-type EndpointResult struct {
-	Endpoint string
-	Latency  time.Duration
-	Protocol string
+func startProgress(s *scanner.Scanner, interval time.Duration) (stop func()) {
+	show := func() {
+		p := s.Progress()
+		fmt.Fprintf(os.Stderr, "\rpinging %d/%d  scanning %d/%d",
+			p.PingsDone, p.PingsTotal, p.ProbesDone, p.ProbesTotal)
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				show()
+			case <-done:
+				show()
+				fmt.Fprintln(os.Stderr)
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
 }
 
-func generateIPv4Addresses() []string {
-	var ips []string
-	subnets := []string{
-		"162.159.192.", "162.159.193.", "162.159.195.",
-		"188.114.96.", "188.114.97.", "188.114.98.", "188.114.99.",
+// maxPorts caps how many ports a list may expand to, duplicates included.
+const maxPorts = 65535
+
+// manyPorts is the list size above which main warns about a long scan.
+const manyPorts = 1000
+
+// rdnsTimeout bounds each reverse DNS lookup for -rdns.
+const rdnsTimeout = 2 * time.Second
+
+// parsePorts parses comma-separated ports and start-end ranges, e.g.
+// 443,500,8880-8890.
+func parsePorts(value string) ([]int, error) {
+	var ports []int
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		startStr, endStr, isRange := strings.Cut(field, "-")
+		start, err := parsePort(startStr)
+		if err != nil {
+			return nil, err
+		}
+		end := start
+		if isRange {
+			if end, err = parsePort(endStr); err != nil {
+				return nil, err
+			}
+			if start > end {
+				return nil, fmt.Errorf("invalid range %q: start is after end", field)
+			}
+		}
+		if len(ports)+end-start+1 > maxPorts {
+			return nil, fmt.Errorf("more than %d ports", maxPorts)
+		}
+		for port := start; port <= end; port++ {
+			ports = append(ports, port)
+		}
 	}
-	for _, subnet := range subnets {
-		for i := 0; i < 5; i++ {
-			ips = append(ips, fmt.Sprintf("%s%d", subnet, rand.Intn(256)))
+	return ports, nil
+}
+
+func parsePort(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	port, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %q", value)
+	}
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port %d out of range (1-65535)", port)
+	}
+	return port, nil
+}
+
+// bestPerIP keeps the first result for each IP. Results for one IP share
+// the same ping stats, so on sorted input that is its lowest-latency port.
+func bestPerIP(results []scanner.EndpointResult) []scanner.EndpointResult {
+	seen := make(map[string]bool)
+	var best []scanner.EndpointResult
+	for _, result := range results {
+		if seen[result.Ping.IP] {
+			continue
 		}
+		seen[result.Ping.IP] = true
+		best = append(best, result)
 	}
-	return ips
+	return best
+}
+
+// answered returns the results that got a reply, leaving out the
+// open|filtered UDP ports that icmp mode only failed to hear a rejection
+// from. It keeps their order.
+func answered(results []scanner.EndpointResult) []scanner.EndpointResult {
+	return slices.DeleteFunc(slices.Clone(results), func(r scanner.EndpointResult) bool {
+		return r.State == scanner.StateOpenFiltered
+	})
 }
 
-func generateIPv6Addresses() []string {
+// fewIPs is the most distinct IPs behind the results for which the scan
+// warns that the endpoint lists mostly repeat the same hosts.
+const fewIPs = 2
+
+// resultIPs returns the distinct IPs behind results, in first-seen order.
+func resultIPs(results ...[]scanner.EndpointResult) []string {
+	seen := make(map[string]bool)
 	var ips []string
-	prefixes := []string{"2606:4700:d0::", "2606:4700:d1::"}
-	for _, prefix := range prefixes {
-		for i := 0; i < 5; i++ {
-			ip := fmt.Sprintf("%s%x:%x:%x:%x",
-				prefix, rand.Intn(0xffff), rand.Intn(0xffff), rand.Intn(0xffff), rand.Intn(0xffff))
-			ips = append(ips, ip)
+	for _, list := range results {
+		for _, result := range list {
+			if !seen[result.Ping.IP] {
+				seen[result.Ping.IP] = true
+				ips = append(ips, result.Ping.IP)
+			}
 		}
 	}
 	return ips
 }
 
-func pingWithTermux(ipAddr string) (time.Duration, error) {
-	cmd := exec.Command("ping", "-c", "3", "-W", "2", ipAddr)
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return 0, err
+// printLowDiversity explains that the endpoint lists below come from only
+// a handful of IPs and suggests how to widen the scan.
+func printLowDiversity(ips []string, endpoints int, pinged bool) {
+	fmt.Println("\n-------------------------------------------------------------")
+	if len(ips) == 1 {
+		fmt.Printf("NOTE: All %d endpoints are ports on a single IP (%s).\n", endpoints, ips[0])
+	} else {
+		fmt.Printf("NOTE: All %d endpoints are ports on only %d IPs (%s).\n", endpoints, len(ips), strings.Join(ips, ", "))
 	}
-	if err := cmd.Start(); err != nil {
-		return 0, err
+	fmt.Println("The lists below rank ports, not different IPs.")
+	if pinged {
+		fmt.Println("For more IPs, try -no-ping (ICMP may be filtered) or a wider -cidr.")
+	} else {
+		fmt.Println("For more IPs, try a wider -cidr.")
 	}
-	scanner := bufio.NewScanner(stdout)
-	var avgRtt time.Duration
-	rttRegex := regexp.MustCompile(`rtt min/avg/max/mdev = [\d.]+/([\d.]+)/[\d.]+/[\d.]+ ms`)
-	for scanner.Scan() {
-		line := scanner.Text()
-		matches := rttRegex.FindStringSubmatch(line)
-		if len(matches) > 1 {
-			avg, err := strconv.ParseFloat(matches[1], 64)
-			if err == nil {
-				avgRtt = time.Duration(avg * float64(time.Millisecond))
-			}
+	fmt.Println("-------------------------------------------------------------")
+}
+
+func firstN(results []scanner.EndpointResult, n int) []scanner.EndpointResult {
+	if n == 0 || n >= len(results) {
+		return results
+	}
+	return results[:n]
+}
+
+// bestBanner prefixes the best-endpoint lines. main swaps it for ASCII with
+// -no-emoji or when stdout is not a terminal.
+var bestBanner = "🏆"
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// formatPing describes the ping stats, or n/a when the IP was not pinged.
+func formatPing(p scanner.PingResult) string {
+	if p.RTT == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%.2f ms, Jitter: %.2f ms, Loss: %.0f%%",
+		float64(p.RTT.Nanoseconds())/1e6, float64(p.Jitter.Nanoseconds())/1e6, p.Loss)
+}
+
+// reachedElsewhere returns the probed target of r if the connection
+// reached another address, and "" otherwise.
+func reachedElsewhere(r scanner.EndpointResult) string {
+	if r.Target == r.Endpoint {
+		return ""
+	}
+	return r.Target
+}
+
+func formatDetails(r scanner.EndpointResult) string {
+	var details string
+	if r.Hostname != "" {
+		details += ", Host: " + r.Hostname
+	}
+	if target := reachedElsewhere(r); target != "" {
+		details += ", Target: " + target
+	}
+	if r.MinLatency != 0 {
+		details += fmt.Sprintf(", Min: %.2f ms", float64(r.MinLatency.Nanoseconds())/1e6)
+	}
+	if r.TLSVersion != "" {
+		details += fmt.Sprintf(", %s %s", r.TLSVersion, r.TLSCipher)
+	}
+	if host, _, err := net.SplitHostPort(r.LocalAddr); err == nil {
+		details += ", Source: " + host
+	}
+	if r.ConnectLatency != 0 {
+		details += fmt.Sprintf(", Connect: %.2f ms", float64(r.ConnectLatency.Nanoseconds())/1e6)
+	}
+	if r.AppRTT != 0 {
+		details += fmt.Sprintf(", App RTT: %.2f ms", float64(r.AppRTT.Nanoseconds())/1e6)
+	}
+	if r.PeerClose != "" {
+		details += fmt.Sprintf(", Close: %.2f ms (%s)", float64(r.CloseLatency.Nanoseconds())/1e6, strings.ToUpper(r.PeerClose))
+	}
+	if r.MSS != 0 {
+		details += fmt.Sprintf(", Kernel RTT: %.2f ms, MSS: %d", float64(r.KernelRTT.Nanoseconds())/1e6, r.MSS)
+	}
+	if r.HTTPStatus != 0 {
+		details += fmt.Sprintf(", HTTP %d, TTFB: %.2f ms", r.HTTPStatus, float64(r.TTFB.Nanoseconds())/1e6)
+	}
+	if r.Signature != "" {
+		details += ", Signature: " + r.Signature
+	}
+	if r.State != "" {
+		details += ", State: " + r.State
+	}
+	if r.ReverseDNS != "" {
+		details += ", rDNS: " + r.ReverseDNS
+	}
+	if r.ASN != 0 {
+		details += fmt.Sprintf(", AS%d %s", r.ASN, r.ASOrg)
+	}
+	return details
+}
+
+// printEndpoints prints the ranked results as numbered lines, or with
+// format "table" as aligned columns under a header row.
+func printEndpoints(results []scanner.EndpointResult, format string) {
+	if format != "table" {
+		for i, result := range results {
+			line := fmt.Sprintf("%d. Endpoint: %s (Latency: %.2f ms, Real Ping: %s%s)", i+1, result.Endpoint, float64(result.Latency.Nanoseconds())/1e6, formatPing(result.Ping), formatDetails(result))
+			fmt.Println(colors.byLatency(line, result.Latency))
+		}
+		return
+	}
+
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tENDPOINT\tLATENCY\tREAL PING\tJITTER\tLOSS")
+	for i, result := range results {
+		ping := "n/a\tn/a\tn/a"
+		if result.Ping.RTT > 0 {
+			ping = fmt.Sprintf("%.2f ms\t%.2f ms\t%.0f%%", float64(result.Ping.RTT.Nanoseconds())/1e6,
+				float64(result.Ping.Jitter.Nanoseconds())/1e6, result.Ping.Loss)
 		}
+		fmt.Fprintf(tw, "%d\t%s\t%.2f ms\t%s\n", i+1, result.Endpoint, float64(result.Latency.Nanoseconds())/1e6, ping)
+	}
+	tw.Flush()
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	fmt.Println(lines[0])
+	for i, line := range lines[1:] {
+		fmt.Println(colors.byLatency(line, results[i].Latency))
 	}
-	if err := cmd.Wait(); err != nil {
-		return 0, fmt.Errorf("no response from host")
+}
+
+type streamRecord struct {
+	Protocol  string  `json:"protocol"`
+	IP        string  `json:"ip"`
+	Port      int     `json:"port"`
+	LatencyMs float64 `json:"latency_ms"`
+	PingMs    float64 `json:"ping_ms"`
+	Hostname  string  `json:"hostname,omitempty"`
+	// Target is the probed ip:port, set when the connection reached a
+	// different address.
+	Target    string `json:"target,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	State     string `json:"state,omitempty"`
+	// Event and Cycle are set by -watch: "open" for every endpoint found
+	// in a cycle, "removed" for one that opened in the previous cycle but
+	// not in this one, repeating its last open record.
+	Event string `json:"event,omitempty"`
+	Cycle int    `json:"cycle,omitempty"`
+}
+
+// writeJSONLine writes result as one NDJSON line for -json-stream. Single
+// runs leave event empty and cycle zero.
+func writeJSONLine(enc *json.Encoder, result scanner.EndpointResult, event string, cycle int) error {
+	host, portStr, err := net.SplitHostPort(result.Endpoint)
+	if err != nil {
+		return err
 	}
-	if avgRtt == 0 {
-		return 0, fmt.Errorf("could not parse RTT")
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
 	}
-	return avgRtt, nil
+	return enc.Encode(streamRecord{
+		Protocol:  result.Protocol,
+		IP:        host,
+		Port:      port,
+		LatencyMs: float64(result.Latency.Nanoseconds()) / 1e6,
+		PingMs:    float64(result.Ping.RTT.Nanoseconds()) / 1e6,
+		Hostname:  result.Hostname,
+		Target:    reachedElsewhere(result),
+		Signature: result.Signature,
+		State:     result.State,
+		Event:     event,
+		Cycle:     cycle,
+	})
 }
 
-func scanPort(ip string, port int, protocol string, timeout time.Duration, resultsChan chan<- EndpointResult, wg *sync.WaitGroup) {
-	defer wg.Done()
-	address := net.JoinHostPort(ip, strconv.Itoa(port))
+var csvHeader = []string{"timestamp", "ip", "port", "protocol", "connect_latency_ms", "real_ping_ms"}
 
-	start := time.Now()
-	conn, err := net.DialTimeout(protocol, address, timeout)
-	latency := time.Since(start)
+func writeCSV(w io.Writer, results []scanner.EndpointResult) error {
+	writer := csv.NewWriter(w)
+	timestamp := time.Now().Format(time.RFC3339)
+	for _, result := range results {
+		host, port, err := net.SplitHostPort(result.Endpoint)
+		if err != nil {
+			return err
+		}
+		record := []string{
+			timestamp,
+			host,
+			port,
+			result.Protocol,
+			strconv.FormatFloat(float64(result.Latency.Nanoseconds())/1e6, 'f', 2, 64),
+			strconv.FormatFloat(float64(result.Ping.RTT.Nanoseconds())/1e6, 'f', 2, 64),
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
 
-	if err == nil {
-		conn.Close()
-		resultsChan <- EndpointResult{Endpoint: address, Latency: latency, Protocol: protocol}
+// appendCSV adds results to the CSV file at path, writing the header to a
+// new file. The file is rewritten atomically with the new rows appended.
+func appendCSV(path string, results []scanner.EndpointResult) error {
+	existing, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	buf := bytes.NewBuffer(existing)
+	if len(existing) == 0 {
+		writer := csv.NewWriter(buf)
+		writer.Write(csvHeader)
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return err
+		}
 	}
+	if err := writeCSV(buf, results); err != nil {
+		return err
+	}
+	return writeAtomic(path, buf.Bytes())
 }
 
-func main() {
-	tcpTimeout := 5 * time.Second
-	udpTimeout := 5 * time.Second
+func renderWireGuardPeer(ep scanner.EndpointResult) string {
+	return fmt.Sprintf("[Peer]\n# %s latency: %.2f ms\nEndpoint = %s\n",
+		ep.Protocol, float64(ep.Latency.Nanoseconds())/1e6, ep.Endpoint)
+}
 
-	rand.Seed(time.Now().UnixNano())
+// scanSummary holds the counters printed in the --- Summary --- block.
+type scanSummary struct {
+	targets    int
+	responsive int
+	probed     int64
+	openTCP    int
+	openUDP    int
+	filtered   int
+	failures   map[string]int
+	blacklist  []string
+	elapsed    time.Duration
+}
 
-	fmt.Println("Step 1: Finding best IPs with ping...")
-	allIPs := append(generateIPv4Addresses(), generateIPv6Addresses()...)
+func printSummary(sum scanSummary) {
+	fmt.Println("\n--- Summary ---")
+	fmt.Printf("IPs targeted:     %d\n", sum.targets)
+	fmt.Printf("Responded:        %d\n", sum.responsive)
+	fmt.Printf("Ports probed:     %d\n", sum.probed)
+	fmt.Printf("Open TCP:         %d\n", sum.openTCP)
+	fmt.Printf("Open UDP:         %d\n", sum.openUDP)
+	if sum.filtered > 0 {
+		fmt.Printf("Open|filtered:    %d\n", sum.filtered)
+	}
+	var failures []string
+	for _, class := range scanner.FailureClasses {
+		if n := sum.failures[class]; n > 0 {
+			failures = append(failures, fmt.Sprintf("%s: %d", class, n))
+		}
+	}
+	if len(failures) > 0 {
+		fmt.Printf("Failed probes:    %s\n", strings.Join(failures, ", "))
+	}
+	if len(sum.blacklist) > 0 {
+		fmt.Printf("Blacklisted:      %s\n", strings.Join(sum.blacklist, ", "))
+	}
+	fmt.Printf("Elapsed:          %s\n", sum.elapsed.Round(time.Millisecond))
+}
 
-	var pingWg sync.WaitGroup
-	pingResultsChan := make(chan PingResult, len(allIPs))
+// main exits 0 when at least one endpoint of the requested protocols
+// answered, 1 when none did and 2 for invalid flags or setup errors.
+// Open|filtered UDP ports are reported but never count as answered. The
+// codes always apply, whatever the output format, and -check uses them for
+// its one endpoint. Runs that send no probes (-dry-run, -resolve-only,
+// -list-presets) and -watch, which only stops when interrupted, exit 0.
+func main() {
+	os.Exit(run())
+}
 
-	for _, ip := range allIPs {
-		pingWg.Add(1)
-		go func(ipAddr string) {
-			defer pingWg.Done()
-			rtt, err := pingWithTermux(ipAddr)
-			if err == nil {
-				pingResultsChan <- PingResult{IP: ipAddr, RTT: rtt}
+func run() int {
+	startTime := time.Now()
+	defaults := scanner.DefaultOptions()
+	tcpTimeout := flag.Duration("tcp-timeout", defaults.TCPTimeout, "timeout for each TCP connect")
+	adaptiveTimeout := flag.Float64("adaptive-timeout", defaults.AdaptiveTimeout, "dial each IP with a timeout of this many times its ping RTT, at least 500ms (0 = always use -tcp-timeout/-udp-timeout)")
+	deadlineSlack := flag.Duration("deadline-slack", 0, "wait this much past -tcp-timeout/-udp-timeout for each probe but count only answers within the timeout, ignoring -adaptive-timeout, so repeated scans of the same targets find more nearly the same endpoints (network variability still applies; 0 = off)")
+	udpTimeout := flag.Duration("udp-timeout", defaults.UDPTimeout, "timeout for each UDP probe")
+	portsFlag := flag.String("ports", "", "comma-separated ports or start-end ranges to scan on both TCP and UDP, e.g. 443,8880-8890 (default: the -preset lists)")
+	ipsPerSubnet := flag.Int("ips-per-subnet", defaults.IPsPerSubnet, "random IPs to sample per subnet, prefix or CIDR block")
+	scanLimit := flag.Int("scan-limit", 0, "scan only the first N IPs to answer ping (0 = all)")
+	maxProbes := flag.Int("max-probes", 0, "send at most N pings and port probes in total, retries included, with up to half for pings (0 = no limit)")
+	noEmoji := flag.Bool("no-emoji", false, "print plain ASCII banners instead of emoji (default when stdout is not a terminal)")
+	noColor := flag.Bool("no-color", false, "print the report without colors (default when stdout is not a terminal)")
+	goodMs := flag.Float64("good-ms", 100, "color endpoints at or above this connect latency in ms yellow")
+	badMs := flag.Float64("bad-ms", 300, "color endpoints at or above this connect latency in ms red")
+	quiet := flag.Bool("quiet", false, "do not print scan progress to stderr")
+	watchInterval := flag.Duration("watch", 0, "re-run the scan every interval and report when the best endpoint changes (0 = run once)")
+	metricsAddr := flag.String("metrics-addr", "", "with -watch, serve Prometheus metrics for the best endpoints on this address, e.g. :9090")
+	duration := flag.Duration("duration", 0, "stop scanning and report what was found after this long (0 = no limit)")
+	cachePath := flag.String("cache", "", "ping the IPs with open ports from this JSON file first, and save this run's ones to it")
+	blacklistThreshold := flag.Int("blacklist-threshold", 0, "with -watch, drop endpoints that opened before but then failed more than N probes, saving the counts to -cache for later runs (0 = off)")
+	cacheTTL := flag.Duration("cache-ttl", 24*time.Hour, "ignore -cache entries older than this (0 = never expire)")
+	seed := flag.Int64("seed", 0, "seed for the random IP sampling and -shuffle, for reproducible runs (0 = derive from the clock)")
+	shuffle := flag.Bool("shuffle", false, "probe each IP's ports in a random order, fixed per IP by -seed (default: the listed order, TCP ports first)")
+	stats := flag.Bool("stats", false, "print RTT percentiles and a histogram of every IP that answered ping")
+	dryRun := flag.Bool("dry-run", false, "print the IPs and probes that would be sent, then exit without sending any traffic")
+	happyEyeballs := flag.Bool("happy-eyeballs", false, "race IPv6 against IPv4 on the TCP ports of each -targets hostname with both, print the winners and exit")
+	resolveOnly := flag.Bool("resolve-only", false, "print the candidate IPs, one per line, then exit without sending any traffic")
+	verbose := flag.Bool("v", false, "log every failed ping and port probe to stderr")
+	showFailures := flag.Bool("show-failures", false, "list every port probe that failed, with the reason, in its own section")
+	warmup := flag.Bool("warmup", false, "send one unmeasured probe to each IP before the measured ones for steadier latencies (one extra probe per IP)")
+	samples := flag.Int("samples", 1, "probe each open endpoint N times and rank it by the median latency")
+	minSuccess := flag.Int("min-success", 1, "require N successful probes, out of N plus -retries attempts, before reporting an endpoint, and rank it by their average latency")
+	retries := flag.Int("retries", 0, "retry each failed port probe up to N times with exponential backoff, waiting at most 5s between tries")
+	concurrency := flag.Int("concurrency", defaults.Concurrency, "maximum number of pings/dials in flight at once")
+	ttfb := flag.Duration("ttfb", 0, "after each TCP connect, wait up to this long for the first byte and rank by time to it (0 = off)")
+	appRTTWait := flag.Duration("app-rtt", 0, "after each TCP connect, write one byte and time the server's answer for up to this long (0 = off)")
+	closeWait := flag.Duration("close-wait", 0, "after each TCP connect, send a FIN and time the server's FIN or RST for up to this long (0 = off)")
+	tcpInfo := flag.Bool("tcp-info", false, "after each TCP connect, report the kernel's RTT estimate and MSS from TCP_INFO (Linux only)")
+	tcpMode := flag.String("tcp-mode", defaults.TCPMode, "TCP probe method: connect (full handshake) or syn (SYN to SYN-ACK time, needs raw sockets)")
+	udpMode := flag.String("udp-mode", defaults.UDPMode, "UDP probe method: wireguard (handshake), echo (random bytes echoed back), icmp (open unless ICMP port unreachable) or dial (legacy, always succeeds)")
+	udpPayloadSize := flag.Int("udp-payload-size", 0, fmt.Sprintf("bytes per datagram sent by -udp-mode echo and icmp (0 = mode default, max %d without -udp-fragment)", scanner.MaxUDPPayload))
+	udpPayloadFill := flag.String("udp-payload-fill", "", "hex pattern repeated to fill -udp-payload-size (default: random for echo, zeros for icmp)")
+	udpFragment := flag.Bool("udp-fragment", false, "allow -udp-payload-size above one 1500-byte MTU packet, letting datagrams fragment")
+	wgPublicKey := flag.String("wg-public-key", scanner.WARPPublicKey, "base64 WireGuard public key of the peer used by -udp-mode wireguard")
+	emitConfig := flag.Bool("emit-config", false, "print a WireGuard [Peer] block for the best endpoint")
+	configProto := flag.String("config-proto", "udp", "protocol of the endpoint used by -emit-config and -clipboard: udp or tcp")
+	clipboard := flag.Bool("clipboard", false, "copy the best endpoint to the clipboard (termux-clipboard-set, pbcopy, wl-copy, xclip or xsel)")
+	weightLatency := flag.Float64("weight-latency", defaults.Weights.Latency, "score weight per ms of connect latency")
+	weightPing := flag.Float64("weight-ping", 1, "score weight per ms of real ping RTT, used by -sort ping and combined")
+	sortBy := flag.String("sort", "connect", "rank endpoints by connect latency, real ping, or a combined blend: connect, ping or combined")
+	weightJitter := flag.Float64("weight-jitter", defaults.Weights.Jitter, "score weight per ms of ping jitter")
+	weightLoss := flag.Float64("weight-loss", defaults.Weights.Loss, "score weight per percent of ping packet loss")
+	forceIPv6 := flag.Bool("force-ipv6", false, "scan IPv6 targets even when no IPv6 connectivity is detected")
+	pingCount := flag.Int("ping-count", defaults.PingCount, "echo requests to send to each IP")
+	pingRate := flag.Float64("ping-rate", defaults.PingRate, "maximum pings started per second (0 = unlimited)")
+	pingRetries := flag.Int("ping-retries", defaults.PingRetries, "re-ping each IP that failed up to N times after a random 0.5-1.5s delay")
+	noPing := flag.Bool("no-ping", false, "skip pinging and port-scan every candidate IP, for networks that drop ICMP")
+	maxPing := flag.Duration("max-ping", 0, "skip port scanning IPs whose average ping exceeds this (0 = no limit)")
+	pingStyle := flag.String("ping-style", "", "argument and output style of the system ping fallback: unix, busybox or windows (default: detected from -ping-path)")
+	pingPath := flag.String("ping-path", defaults.PingPath, "system ping fallback to run when raw ICMP sockets are not permitted, as a command name or a file path")
+	proto := flag.String("proto", "both", "protocols to probe: tcp, udp or both")
+	tlsProbe := flag.Bool("tls", false, "complete a TLS handshake on port 443 and -tls-ports instead of a plain TCP connect")
+	tlsPortsFlag := flag.String("tls-ports", "", "extra comma-separated TCP ports to probe with TLS when -tls is set")
+	tlsServerName := flag.String("tls-sni", "", "server name sent in the TLS ClientHello")
+	top := flag.Int("top", 6, "number of endpoints to list per protocol (0 = all)")
+	format := flag.String("format", "list", "layout of the endpoint lists: list or table")
+	compare := flag.Bool("compare", false, "also print TCP and UDP latencies side by side for each ip:port")
+	view := flag.String("view", "ranked", "result layout: ranked (best endpoints per protocol) or by-ip (each IP by real ping, with its open ports by latency)")
+	groupByIP := flag.Bool("group-by-ip", false, "list each IP once, with its lowest-latency open port")
+	httpPath := flag.String("http-path", "", "send an HTTP GET for this path on -http-ports and require a 2xx/3xx answer")
+	httpPortsFlag := flag.String("http-ports", "", "comma-separated TCP ports probed with -http-path (default: every TCP port)")
+	probeSend := flag.String("probe-send", "", "hex payload to send after connecting on -probe-ports, over TCP and UDP")
+	probeExpect := flag.String("probe-expect", "", "hex prefix the reply to -probe-send must start with to report a signature match")
+	probePortsFlag := flag.String("probe-ports", "", "comma-separated ports probed with -probe-send (default: every port)")
+	keepAlive := flag.Duration("keepalive", 0, "TCP keep-alive period of probe connections (0 = Go default of 15s, negative = disabled)")
+	noDelay := flag.Bool("no-delay", true, "set TCP_NODELAY on probe connections; -no-delay=false re-enables Nagle's algorithm")
+	linger := flag.Int("linger", defaults.Linger, "SO_LINGER seconds for probe connections, 0 resets them on close (negative = OS default)")
+	probeCmd := flag.String("probe-cmd", "", "run this command for every open endpoint, e.g. './myprobe {ip} {port}', and use the latency in ms it prints")
+	iface := flag.String("interface", "", "send probes from the address of this network interface, e.g. wlan0")
+	localPortsFlag := flag.String("local-ports", "", "send probes from these source ports, e.g. 40000-41000; implies -linger 0 unless set, so closed TCP ports free up at once")
+	proxyFlag := flag.String("proxy", "", "route TCP probes through this SOCKS5 proxy, e.g. socks5://127.0.0.1:1080 (skips ping and UDP)")
+	jsonStream := flag.Bool("json-stream", false, "write each open endpoint to stdout as an NDJSON line as soon as it is found, instead of the report")
+	rdns := flag.Bool("rdns", false, "annotate reported endpoints with the reverse DNS name of their IP")
+	asnDBPath := flag.String("asn-db", "", "annotate reported endpoints with their ASN from this ip2asn TSV file (e.g. ip2asn-combined.tsv from iptoasn.com)")
+	bundlePath := flag.String("bundle", "", "write the results (NDJSON and CSV), a debug log and the run's flags and platform to this zip file, e.g. for bug reports")
+	csvPath := flag.String("csv", "", "append the top endpoints to this CSV file")
+	targetsPath := flag.String("targets", "", "read target IPs or hostnames (optionally with :port) from this file, one per line (- for stdin)")
+	checkFlag := flag.String("check", "", "probe just this ip:port (also accepted as the only argument) and exit non-zero if it is unreachable")
+	excludeFlag := flag.String("exclude", "", "comma-separated IPs and CIDR blocks never to scan, e.g. 162.159.192.1,188.114.96.0/28")
+	var ipv6Prefixes []string
+	flag.Func("ipv6-prefix", "IPv6 CIDR block to sample instead of the -preset prefixes, e.g. 2606:4700:d0::/48 (repeatable or comma-separated)", func(value string) error {
+		for _, part := range strings.Split(value, ",") {
+			prefix, err := scanner.ParseIPv6Prefix(part)
+			if err != nil {
+				return err
 			}
-		}(ip)
+			ipv6Prefixes = append(ipv6Prefixes, prefix)
+		}
+		return nil
+	})
+	sampleSubnetsN := flag.Int("sample-subnets", 0, "ping N random IPs per subnet, print the subnets ranked by median ping and exit (0 = off)")
+	deepScanTop := flag.Int("deep-scan-top", 0, "with -sample-subnets, go on to a full scan of the K best subnets instead of exiting")
+	presetFlag := flag.String("preset", scanner.DefaultPreset, "built-in provider whose subnets, prefixes and ports to scan (see -list-presets)")
+	listPresets := flag.Bool("list-presets", false, "list the built-in -preset names and exit")
+	cidrFlag := flag.String("cidr", "", "comma-separated IPv4/IPv6 CIDR blocks to scan instead of the -preset subnets")
+	subnetsFlag := flag.String("subnets", "", "comma-separated /24 prefixes to sample instead of the -preset IPv4 subnets, e.g. 162.159.192.,188.114.96.")
+	selfTest := flag.Bool("self-test", false, "scan TCP and UDP listeners on localhost, print PASS or FAIL and exit non-zero on failure")
+	configPath := flag.String("config", "", "read flag values from this JSON file, keyed by flag name; flags on the command line take precedence")
+	flag.Parse()
+	if *configPath != "" {
+		if err := loadConfig(flag.CommandLine, *configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -config:\n%v\n", err)
+			return 2
+		}
 	}
 
-	pingWg.Wait()
-	close(pingResultsChan)
+	if *listPresets {
+		printPresets()
+		return 0
+	}
 
-	var bestIPs []PingResult
-	for result := range pingResultsChan {
-		bestIPs = append(bestIPs, result)
+	if *noEmoji || !isTerminal(os.Stdout) {
+		bestBanner = "[BEST]"
+	}
+	if *goodMs < 0 || *badMs < *goodMs {
+		fmt.Fprintln(os.Stderr, "Invalid -good-ms/-bad-ms: must satisfy 0 <= good <= bad")
+		return 2
+	}
+	colors = colorizer{
+		enabled: !*noColor && isTerminal(os.Stdout),
+		good:    time.Duration(*goodMs * float64(time.Millisecond)),
+		bad:     time.Duration(*badMs * float64(time.Millisecond)),
 	}
 
-	if len(bestIPs) == 0 {
-		fmt.Println("No responsive IPs found in Step 1. Exiting.")
-		return
+	level := slog.LevelInfo
+	if *verbose {
+		level = slog.LevelDebug
 	}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+	var debugLog bytes.Buffer
+	if *bundlePath != "" {
+		handler = slog.NewMultiHandler(handler, slog.NewTextHandler(&debugLog, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+	logger := slog.New(handler)
 
-	sort.Slice(bestIPs, func(i, j int) bool {
-		return bestIPs[i].RTT < bestIPs[j].RTT
-	})
+	opts := defaults
+	preset, ok := scanner.Presets[*presetFlag]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Invalid -preset: unknown preset %q (see -list-presets)\n", *presetFlag)
+		return 2
+	}
+	opts.IPv4Subnets, opts.IPv6Prefixes = preset.IPv4Subnets, preset.IPv6Prefixes
+	opts.TCPPorts, opts.UDPPorts = preset.TCPPorts, preset.UDPPorts
+	sanitize := func(name string, ports []int) []int {
+		normalized := normalizePorts(ports)
+		if removed := len(ports) - len(normalized); removed > 0 {
+			logger.Warn("removed duplicate ports", "list", name, "duplicates", removed)
+		}
+		return normalized
+	}
+	opts.TCPPorts = sanitize("preset TCP", opts.TCPPorts)
+	opts.UDPPorts = sanitize("preset UDP", opts.UDPPorts)
+	if *portsFlag != "" {
+		ports, err := parsePorts(*portsFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid -ports:", err)
+			return 2
+		}
+		if len(ports) > 0 {
+			ports = sanitize("-ports", ports)
+			if len(ports) > manyPorts {
+				logger.Warn("scanning a large port list on every responsive IP", "ports", len(ports))
+			}
+			opts.TCPPorts, opts.UDPPorts = ports, ports
+		}
+	}
+	if *ipsPerSubnet < 1 {
+		fmt.Fprintln(os.Stderr, "Invalid -ips-per-subnet: must be at least 1")
+		return 2
+	}
+	if *ipsPerSubnet > 256 && *cidrFlag == "" && *targetsPath == "" {
+		logger.Warn("a /24 subnet only has 256 hosts, capping IPs per subnet to 256", "ips-per-subnet", *ipsPerSubnet)
+	}
+	if *pingRate < 0 {
+		fmt.Fprintln(os.Stderr, "Invalid -ping-rate: must not be negative")
+		return 2
+	}
+	if *watchInterval < 0 {
+		fmt.Fprintln(os.Stderr, "Invalid -watch: must not be negative")
+		return 2
+	}
+	if *duration < 0 {
+		fmt.Fprintln(os.Stderr, "Invalid -duration: must not be negative")
+		return 2
+	}
+	if *metricsAddr != "" && *watchInterval == 0 {
+		fmt.Fprintln(os.Stderr, "Invalid -metrics-addr: requires -watch")
+		return 2
+	}
+	if *sampleSubnetsN < 0 || *deepScanTop < 0 {
+		fmt.Fprintln(os.Stderr, "Invalid -sample-subnets/-deep-scan-top: must not be negative")
+		return 2
+	}
+	if *deepScanTop > 0 && *sampleSubnetsN == 0 {
+		fmt.Fprintln(os.Stderr, "Invalid -deep-scan-top: requires -sample-subnets")
+		return 2
+	}
+	if *sampleSubnetsN > 0 && *targetsPath != "" {
+		fmt.Fprintln(os.Stderr, "Invalid -sample-subnets: cannot be combined with -targets")
+		return 2
+	}
+	if *bundlePath != "" && *watchInterval > 0 {
+		fmt.Fprintln(os.Stderr, "Invalid -bundle: cannot be combined with -watch")
+		return 2
+	}
+	if *showFailures && *watchInterval > 0 {
+		fmt.Fprintln(os.Stderr, "Invalid -show-failures: cannot be combined with -watch")
+		return 2
+	}
+	if *blacklistThreshold < 0 {
+		fmt.Fprintln(os.Stderr, "Invalid -blacklist-threshold: must not be negative")
+		return 2
+	}
+	if *blacklistThreshold > 0 && *watchInterval == 0 && *cachePath == "" {
+		fmt.Fprintln(os.Stderr, "Invalid -blacklist-threshold: requires -watch or -cache")
+		return 2
+	}
+	if *cacheTTL < 0 {
+		fmt.Fprintln(os.Stderr, "Invalid -cache-ttl: must not be negative")
+		return 2
+	}
+	if *maxProbes < 0 {
+		fmt.Fprintln(os.Stderr, "Invalid -max-probes: must not be negative")
+		return 2
+	}
+	if *ttfb < 0 {
+		fmt.Fprintln(os.Stderr, "Invalid -ttfb: must not be negative")
+		return 2
+	}
+	if *appRTTWait < 0 {
+		fmt.Fprintln(os.Stderr, "Invalid -app-rtt: must not be negative")
+		return 2
+	}
+	if *deadlineSlack < 0 {
+		fmt.Fprintln(os.Stderr, "Invalid -deadline-slack: must not be negative")
+		return 2
+	}
+	if *closeWait < 0 {
+		fmt.Fprintln(os.Stderr, "Invalid -close-wait: must not be negative")
+		return 2
+	}
+	if *maxPing < 0 {
+		fmt.Fprintln(os.Stderr, "Invalid -max-ping: must not be negative")
+		return 2
+	}
+	if *format != "list" && *format != "table" {
+		fmt.Fprintln(os.Stderr, "Invalid -format: must be list or table")
+		return 2
+	}
+	if *view != "ranked" && *view != "by-ip" {
+		fmt.Fprintln(os.Stderr, "Invalid -view: must be ranked or by-ip")
+		return 2
+	}
+	if *view == "by-ip" && *groupByIP {
+		fmt.Fprintln(os.Stderr, "Invalid -group-by-ip: -view by-ip already groups by IP")
+		return 2
+	}
+	if *samples < 1 {
+		fmt.Fprintln(os.Stderr, "Invalid -samples: must be at least 1")
+		return 2
+	}
+	if *minSuccess < 1 {
+		fmt.Fprintln(os.Stderr, "Invalid -min-success: must be at least 1")
+		return 2
+	}
+	if *minSuccess > 1 && *samples > 1 {
+		fmt.Fprintln(os.Stderr, "Invalid -min-success: cannot be combined with -samples")
+		return 2
+	}
+	excluded, err := scanner.ParseExclusions(*excludeFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid -exclude:", err)
+		return 2
+	}
+	if *adaptiveTimeout < 0 {
+		fmt.Fprintln(os.Stderr, "Invalid -adaptive-timeout: must not be negative")
+		return 2
+	}
+	if *retries < 0 {
+		fmt.Fprintln(os.Stderr, "Invalid -retries: must not be negative")
+		return 2
+	}
+	if *pingRetries < 0 {
+		fmt.Fprintln(os.Stderr, "Invalid -ping-retries: must not be negative")
+		return 2
+	}
+	if *concurrency < 1 {
+		fmt.Fprintln(os.Stderr, "Invalid -concurrency: must be at least 1")
+		return 2
+	}
+	if *pingCount < 1 {
+		fmt.Fprintln(os.Stderr, "Invalid -ping-count: must be at least 1")
+		return 2
+	}
+	if *tcpMode != "connect" && *tcpMode != "syn" {
+		fmt.Fprintln(os.Stderr, "Invalid -tcp-mode: must be connect or syn")
+		return 2
+	}
+	if *udpMode != "wireguard" && *udpMode != "echo" && *udpMode != "icmp" && *udpMode != "dial" {
+		fmt.Fprintln(os.Stderr, "Invalid -udp-mode: must be wireguard, echo, icmp or dial")
+		return 2
+	}
+	if *udpPayloadSize != 0 || *udpPayloadFill != "" {
+		if *udpMode != "echo" && *udpMode != "icmp" {
+			fmt.Fprintln(os.Stderr, "Invalid -udp-payload-size: requires -udp-mode echo or icmp")
+			return 2
+		}
+		limit := scanner.MaxUDPPayload
+		if *udpFragment {
+			limit = scanner.MaxUDPDatagram
+		}
+		if *udpPayloadSize < 0 || *udpPayloadSize > limit {
+			fmt.Fprintf(os.Stderr, "Invalid -udp-payload-size: must be between 0 and %d\n", limit)
+			return 2
+		}
+		fill, err := hex.DecodeString(*udpPayloadFill)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid -udp-payload-fill:", err)
+			return 2
+		}
+		opts.UDPPayloadSize = *udpPayloadSize
+		opts.UDPPayloadFill = fill
+		opts.AllowFragmentation = *udpFragment
+	}
+	key, err := base64.StdEncoding.DecodeString(*wgPublicKey)
+	if err != nil || len(key) != 32 {
+		fmt.Fprintln(os.Stderr, "Invalid -wg-public-key: must be a base64-encoded 32-byte key")
+		return 2
+	}
+	if *tlsProbe {
+		ports, err := parsePorts(*tlsPortsFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid -tls-ports:", err)
+			return 2
+		}
+		opts.TLSPorts = normalizePorts(append([]int{443}, ports...))
+	}
+	if *top < 0 {
+		fmt.Fprintln(os.Stderr, "Invalid -top: must not be negative")
+		return 2
+	}
+	if *httpPath != "" {
+		if !strings.HasPrefix(*httpPath, "/") {
+			fmt.Fprintln(os.Stderr, "Invalid -http-path: must start with /")
+			return 2
+		}
+		ports, err := parsePorts(*httpPortsFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid -http-ports:", err)
+			return 2
+		}
+		opts.HTTPPath = *httpPath
+		opts.HTTPPorts = normalizePorts(ports)
+	}
+	if *probeExpect != "" && *probeSend == "" {
+		fmt.Fprintln(os.Stderr, "Invalid -probe-expect: requires -probe-send")
+		return 2
+	}
+	if *probeSend != "" {
+		payload, err := hex.DecodeString(*probeSend)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid -probe-send:", err)
+			return 2
+		}
+		expect, err := hex.DecodeString(*probeExpect)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid -probe-expect:", err)
+			return 2
+		}
+		ports, err := parsePorts(*probePortsFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid -probe-ports:", err)
+			return 2
+		}
+		opts.ProbeSend = payload
+		opts.ProbeExpect = expect
+		opts.ProbePorts = normalizePorts(ports)
+	}
+	if *proxyFlag != "" {
+		proxyURL, err := url.Parse(*proxyFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid -proxy:", err)
+			return 2
+		}
+		opts.Proxy = proxyURL
+		if *configProto == "udp" && *emitConfig {
+			fmt.Fprintln(os.Stderr, "Invalid -config-proto: UDP is not probed through -proxy, use -config-proto tcp")
+			return 2
+		}
+	}
+	switch *proto {
+	case "tcp", "udp":
+		opts.Protocol = *proto
+	case "both":
+	default:
+		fmt.Fprintln(os.Stderr, "Invalid -proto: must be tcp, udp or both")
+		return 2
+	}
+	if *emitConfig && *proto != "both" && *configProto != *proto {
+		fmt.Fprintf(os.Stderr, "Invalid -config-proto: %s is not probed with -proto %s\n", *configProto, *proto)
+		return 2
+	}
+	if *configProto != "udp" && *configProto != "tcp" {
+		fmt.Fprintln(os.Stderr, "Invalid -config-proto: must be udp or tcp")
+		return 2
+	}
+	opts.IPsPerSubnet = *ipsPerSubnet
+	opts.NoPing = *noPing
+	if ipv6Prefixes != nil {
+		opts.IPv6Prefixes = ipv6Prefixes
+	}
+	var subnets []string
+	for _, prefix := range strings.Split(*subnetsFlag, ",") {
+		if strings.TrimSpace(prefix) == "" {
+			continue
+		}
+		subnet, err := scanner.ParseIPv4Subnet(prefix)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid -subnets:", err)
+			return 2
+		}
+		subnets = append(subnets, subnet)
+	}
+	if subnets != nil {
+		opts.IPv4Subnets = subnets
+	}
+	opts.PingCount = *pingCount
+	opts.PingStyle = *pingStyle
+	if opts.PingStyle == "" {
+		opts.PingStyle = scanner.PingStyleOf(*pingPath)
+	}
+	opts.PingPath = *pingPath
+	opts.PingRate = *pingRate
+	opts.PingRetries = *pingRetries
+	opts.MaxPing = *maxPing
+	opts.TCPTimeout = *tcpTimeout
+	opts.UDPTimeout = *udpTimeout
+	opts.AdaptiveTimeout = *adaptiveTimeout
+	opts.DeadlineSlack = *deadlineSlack
+	opts.TCPMode = *tcpMode
+	opts.TTFBWait = *ttfb
+	opts.AppRTTWait = *appRTTWait
+	opts.TCPInfo = *tcpInfo
+	opts.CloseWait = *closeWait
+	opts.UDPMode = *udpMode
+	opts.WireGuardPublicKey = key
+	opts.TLSServerName = *tlsServerName
+	opts.ScanLimit = *scanLimit
+	opts.Shuffle = *shuffle
+	opts.MaxProbes = *maxProbes
+	opts.Retries = *retries
+	opts.Samples = *samples
+	opts.MinSuccess = *minSuccess
+	opts.Warmup = *warmup
+	opts.Concurrency = *concurrency
+	opts.Weights = scanner.Weights{Latency: *weightLatency, Jitter: *weightJitter, Loss: *weightLoss}
+	switch *sortBy {
+	case "connect":
+	case "ping":
+		opts.Weights.Latency, opts.Weights.Ping = 0, *weightPing
+	case "combined":
+		opts.Weights.Ping = *weightPing
+	default:
+		fmt.Fprintln(os.Stderr, "Invalid -sort: must be connect, ping or combined")
+		return 2
+	}
+	opts.Logger = logger
+	var failed *failureLog
+	if *showFailures {
+		failed = &failureLog{}
+		opts.OnFailure = failed.add
+	}
+	opts.Interface = *iface
+	opts.ProbeCommand = strings.Fields(*probeCmd)
+	opts.KeepAlive = *keepAlive
+	opts.Nagle = !*noDelay
+	opts.Linger = *linger
+	if *localPortsFlag != "" {
+		ports, err := parsePorts(*localPortsFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid -local-ports:", err)
+			return 2
+		}
+		opts.LocalPorts = normalizePorts(ports)
+		lingerSet := false
+		flag.Visit(func(f *flag.Flag) { lingerSet = lingerSet || f.Name == "linger" })
+		if !lingerSet {
+			opts.Linger = 0
+		}
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	logger.Debug("random IP sampling", "seed", *seed)
+	if opts.UDPPayloadSize > 0 {
+		logger.Debug("UDP probe payload", "mode", opts.UDPMode, "size", opts.UDPPayloadSize, "fill", *udpPayloadFill)
+	}
+	opts.Rand = rand.New(rand.NewSource(*seed))
+	opts.Seed = *seed
+	for _, cidr := range strings.Split(*cidrFlag, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr != "" {
+			opts.CIDRs = append(opts.CIDRs, cidr)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *duration > 0 && *watchInterval == 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
 
-	ipToPing := make(map[string]time.Duration)
-	for _, ipResult := range bestIPs {
-		ipToPing[ipResult.IP] = ipResult.RTT
+	if *selfTest {
+		return runSelfTest(ctx, logger)
+	}
+	if *checkFlag == "" && flag.NArg() == 1 {
+		*checkFlag = flag.Arg(0)
+	}
+	if *checkFlag != "" {
+		s, err := scanner.New(opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid options:", err)
+			return 2
+		}
+		pingSkippedBy := ""
+		if opts.Proxy != nil {
+			pingSkippedBy = "-proxy"
+		} else if opts.NoPing {
+			pingSkippedBy = "-no-ping"
+		}
+		return runCheck(ctx, s, *checkFlag, pingSkippedBy)
 	}
 
-	fmt.Println("Step 1 Complete. Best IPs found.")
-	fmt.Println("\nStep 2: Scanning specific TCP and UDP ports on all found IPs...")
+	var fileIPs []string
+	if *targetsPath != "" {
+		input := os.Stdin
+		if *targetsPath != "-" {
+			file, err := os.Open(*targetsPath)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Could not open -targets:", err)
+				return 2
+			}
+			defer file.Close()
+			input = file
+		}
+		targets, err := scanner.LoadTargets(input)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -targets:\n%v\n", err)
+			return 2
+		}
+		fileIPs = targets.IPs
+		opts.TargetPorts = targets.Ports
+		opts.TargetHosts = targets.Hostnames
+	}
+	var asnDB *scanner.ASNDB
+	if *asnDBPath != "" {
+		file, err := os.Open(*asnDBPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Could not open -asn-db:", err)
+			return 2
+		}
+		asnDB, err = scanner.LoadASNDB(file)
+		file.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid -asn-db:", err)
+			return 2
+		}
+	}
+	useIPv6 := *forceIPv6 || scanner.HasIPv6()
+	buildTargets := func() ([]string, error) {
+		allIPs := fileIPs
+		if *targetsPath == "" {
+			var err error
+			allIPs, err = scanner.GenerateTargets(opts)
+			if err != nil {
+				return nil, err
+			}
+			if *cachePath != "" {
+				cached, err := loadCache(*cachePath, *cacheTTL)
+				if err != nil {
+					logger.Warn("could not read cache", "path", *cachePath, "err", err)
+				}
+				seen := make(map[string]bool, len(cached))
+				for _, ip := range cached {
+					seen[ip] = true
+				}
+				for _, ip := range allIPs {
+					if !seen[ip] {
+						cached = append(cached, ip)
+					}
+				}
+				allIPs = cached
+			}
+		}
+		if !useIPv6 {
+			var v6IPs []string
+			allIPs, v6IPs = scanner.SplitByFamily(allIPs)
+			if len(v6IPs) > 0 {
+				logger.Info("no IPv6 connectivity detected, skipping IPv6 targets (use -force-ipv6 to override)", "skipped", len(v6IPs))
+			}
+		}
+		if len(excluded) > 0 {
+			kept := scanner.ExcludeTargets(allIPs, excluded)
+			logger.Debug("skipping -exclude targets", "skipped", len(allIPs)-len(kept))
+			allIPs = kept
+		}
+		return allIPs, nil
+	}
+	if *sampleSubnetsN > 0 {
+		sampler, err := scanner.New(opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid options:", err)
+			return 2
+		}
+		if sampler.SkipsPing() {
+			fmt.Fprintln(os.Stderr, "Invalid -sample-subnets: subnets are ranked by ping, which this scan skips")
+			return 2
+		}
+		ranks, err := sampleSubnets(ctx, sampler, opts, subnetCIDRs(opts, useIPv6), *sampleSubnetsN, excluded)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid -cidr:", err)
+			return 2
+		}
+		printSubnetRanking(ranks)
+		var best []string
+		for _, rank := range ranks {
+			if len(rank.pings) > 0 && len(best) < *deepScanTop {
+				best = append(best, rank.cidr)
+			}
+		}
+		if len(ranks) == 0 || len(ranks[0].pings) == 0 {
+			fmt.Println("No sampled IP responded to ping.")
+			return 1
+		}
+		if *deepScanTop == 0 {
+			return 0
+		}
+		fmt.Printf("\nDeep-scanning the best %d subnets: %s\n", len(best), strings.Join(best, ", "))
+		opts.CIDRs = best
+	}
+	allIPs, err := buildTargets()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid -cidr:", err)
+		return 2
+	}
+	if *resolveOnly {
+		for _, ip := range allIPs {
+			fmt.Println(ip)
+		}
+		return 0
+	}
 
-	tcpPorts := []int{443, 8886, 908, 8854, 4198, 955, 988, 3854, 894, 7156, 1074, 939, 864, 854, 1070, 3476, 1387, 7559, 890, 1018}
-	udpPorts := []int{500, 1701, 4500, 2408, 878, 2371}
+	s, err := scanner.New(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid options:", err)
+		return 2
+	}
 
-	var portWg sync.WaitGroup
-	endpointResultsChan := make(chan EndpointResult, len(bestIPs)*(len(tcpPorts)+len(udpPorts)))
+	if *happyEyeballs {
+		return runHappyEyeballs(ctx, s, allIPs, opts.TargetHosts)
+	}
 
-	for _, ipResult := range bestIPs {
-		for _, port := range tcpPorts {
-			portWg.Add(1)
-			go scanPort(ipResult.IP, port, "tcp", tcpTimeout, endpointResultsChan, &portWg)
+	if *dryRun {
+		probes := s.Plan(allIPs)
+		fmt.Fprintf(os.Stderr, "Dry run: %d IPs, %d probes\n", len(allIPs), len(probes))
+		if !s.SkipsPing() {
+			for _, ip := range allIPs {
+				fmt.Println("ping", ip)
+			}
 		}
+		for _, probe := range probes {
+			fmt.Println(probe.Protocol, net.JoinHostPort(probe.IP, strconv.Itoa(probe.Port)))
+		}
+		return 0
 	}
 
-	for _, ipResult := range bestIPs {
-		for _, port := range udpPorts {
-			portWg.Add(1)
-			go scanPort(ipResult.IP, port, "udp", udpTimeout, endpointResultsChan, &portWg)
+	var bl *blacklist
+	if *blacklistThreshold > 0 {
+		bl, err = newBlacklist(*blacklistThreshold, *cachePath)
+		if err != nil {
+			logger.Warn("could not read cache", "path", *cachePath, "err", err)
 		}
 	}
 
-	portWg.Wait()
-	close(endpointResultsChan)
-
-	var tcpResults []EndpointResult
-	var udpResults []EndpointResult
+	if *watchInterval > 0 {
+		var metrics *watchMetrics
+		if *metricsAddr != "" {
+			metrics = serveMetrics(*metricsAddr, logger)
+		}
+		first := true
+		watch(ctx, opts, *watchInterval, *duration, *jsonStream, metrics, bl, func() []string {
+			if first {
+				first = false
+				return allIPs
+			}
+			ips, err := buildTargets()
+			if err != nil {
+				logger.Error("could not build targets", "err", err)
+			}
+			return ips
+		})
+		return 0
+	}
 
-	for result := range endpointResultsChan {
+	var tcpResults []scanner.EndpointResult
+	var udpResults []scanner.EndpointResult
+	if !*jsonStream {
+		protocols := "TCP and UDP"
+		if opts.Protocol != "" {
+			protocols = strings.ToUpper(opts.Protocol)
+		}
+		switch {
+		case opts.Proxy != nil:
+			fmt.Printf("Scanning TCP ports on every candidate IP through %s (ping and UDP are skipped)...\n", opts.Proxy.Redacted())
+		case s.SkipsPing():
+			fmt.Printf("Scanning %s ports on every candidate IP without pinging...\n", protocols)
+		default:
+			fmt.Printf("Pinging candidate IPs and scanning %s ports on each one that responds...\n", protocols)
+		}
+	}
+	results := s.Pipeline(ctx, allIPs)
+	stopProgress := func() {}
+	if !*quiet && !*verbose {
+		stopProgress = startProgress(s, 200*time.Millisecond)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for result := range results {
+		if !bl.admit(result) {
+			continue
+		}
+		if *jsonStream {
+			if err := writeJSONLine(enc, result, "", 0); err != nil {
+				logger.Error("could not write JSON", "err", err)
+			}
+		}
 		if result.Protocol == "tcp" {
 			tcpResults = append(tcpResults, result)
 		} else {
 			udpResults = append(udpResults, result)
 		}
 	}
+	stopProgress()
+	if *bundlePath != "" {
+		meta := newBundleMeta(flag.CommandLine)
+		defer func() {
+			if err := writeBundle(*bundlePath, append(slices.Clone(tcpResults), udpResults...), debugLog.Bytes(), meta); err != nil {
+				logger.Error("could not write bundle", "path", *bundlePath, "err", err)
+			}
+		}()
+	}
+	answeredUDP := answered(udpResults)
+	if *jsonStream {
+		if len(tcpResults)+len(answeredUDP) == 0 {
+			return 1
+		}
+		return 0
+	}
+	// annotate looks up only the endpoints that are about to be printed.
+	annotate := func(results []scanner.EndpointResult) {
+		if *rdns || asnDB != nil {
+			var timeout time.Duration
+			if *rdns {
+				timeout = rdnsTimeout
+			}
+			scanner.Annotate(ctx, results, asnDB, timeout)
+		}
+	}
+	summary := scanSummary{
+		targets:    len(allIPs),
+		responsive: s.ResponsiveIPs(),
+		probed:     s.Progress().ProbesDone,
+		openTCP:    len(tcpResults),
+		openUDP:    len(answeredUDP),
+		filtered:   len(udpResults) - len(answeredUDP),
+		failures:   s.Failures(),
+		blacklist:  bl.listed(),
+	}
+	defer func() {
+		summary.elapsed = time.Since(startTime)
+		printSummary(summary)
+	}()
+
+	deadlineHit := errors.Is(ctx.Err(), context.DeadlineExceeded)
+	if s.ResponsiveIPs() == 0 {
+		if deadlineHit {
+			fmt.Printf("\nTime budget of %s ran out before any IP responded to ping.\n", *duration)
+		} else if ctx.Err() != nil {
+			fmt.Println("\nScan interrupted before any IP responded to ping.")
+		} else if slow := s.SlowIPs(); slow > 0 {
+			fmt.Printf("All %d responsive IPs were slower than -max-ping %s. Exiting.\n", slow, *maxPing)
+		} else {
+			fmt.Println("No responsive IPs found. Exiting.")
+		}
+		return 1
+	}
 
-	if len(tcpResults) == 0 && len(udpResults) == 0 {
+	if deadlineHit {
+		fmt.Printf("\nTime budget of %s reached. Showing partial results.\n", *duration)
+	} else if ctx.Err() != nil {
+		fmt.Println("\nScan interrupted. Showing partial results.")
+	} else if s.BudgetSpent() {
+		fmt.Printf("\nProbe budget of %d reached. Showing partial results.\n", *maxProbes)
+	}
+	if *stats {
+		printPingStats(s.Pings())
+	}
+	if failed != nil {
+		failed.print()
+	}
+
+	if len(tcpResults) == 0 && len(answeredUDP) == 0 {
+		if n := len(udpResults); n > 0 {
+			fmt.Printf("\n%d UDP ports sent no ICMP port unreachable but never answered either (open|filtered).\n", n)
+		}
+		if deadlineHit {
+			fmt.Println("No open TCP or UDP ports were found within the time budget.")
+			return 1
+		}
 		fmt.Println("\n-------------------------------------------------------------")
 		fmt.Println("CRITICAL: Could not find any open TCP or UDP ports.")
 		fmt.Println("This may be due to heavy network restrictions.")
 		fmt.Println("-------------------------------------------------------------")
-		return
+		return 1
 	}
 
-	fmt.Println("\n--- TCP Results ---")
-	if len(tcpResults) > 0 {
-		sort.Slice(tcpResults, func(i, j int) bool {
-			return tcpResults[i].Latency < tcpResults[j].Latency
-		})
-		bestEndpoint := tcpResults[0]
-		host, _, _ := net.SplitHostPort(bestEndpoint.Endpoint)
-		realPing := ipToPing[host]
-		fmt.Printf("🏆 Best TCP Endpoint: %s\n", bestEndpoint.Endpoint)
-		fmt.Printf("   Latency: %.2f ms (Real Ping: %.2f ms)\n\n", float64(bestEndpoint.Latency.Nanoseconds())/1e6, float64(realPing.Nanoseconds())/1e6)
+	if ips := resultIPs(tcpResults, udpResults); len(ips) <= fewIPs && len(tcpResults)+len(udpResults) > len(ips) {
+		printLowDiversity(ips, len(tcpResults)+len(udpResults), !s.SkipsPing())
+	}
 
-		fmt.Println("--- Top 6 TCP Endpoints ---")
-		for i, result := range tcpResults {
-			if i >= 6 {
-				break
+	if *view == "by-ip" {
+		s.SortResults(tcpResults)
+		s.SortResults(udpResults)
+		printByIP(resultsByIP(append(slices.Clone(tcpResults), udpResults...)), *top, annotate)
+	}
+
+	if *proto != "udp" && *view == "ranked" {
+		fmt.Println("\n--- TCP Results ---")
+		if len(tcpResults) > 0 {
+			s.SortResults(tcpResults)
+			if *groupByIP {
+				tcpResults = bestPerIP(tcpResults)
 			}
-			host, _, _ := net.SplitHostPort(result.Endpoint)
-			realPing := ipToPing[host]
-			fmt.Printf("%d. Endpoint: %s (Latency: %.2f ms, Real Ping: %.2f ms)\n", i+1, result.Endpoint, float64(result.Latency.Nanoseconds())/1e6, float64(realPing.Nanoseconds())/1e6)
+			annotate(firstN(tcpResults, *top))
+			bestEndpoint := tcpResults[0]
+			fmt.Println(colors.best(fmt.Sprintf("%s Best TCP Endpoint: %s", bestBanner, bestEndpoint.Endpoint)))
+			fmt.Println(colors.best(fmt.Sprintf("   Latency: %.2f ms (Real Ping: %s%s)", float64(bestEndpoint.Latency.Nanoseconds())/1e6, formatPing(bestEndpoint.Ping), formatDetails(bestEndpoint))))
+			fmt.Println()
+
+			if *top == 0 {
+				fmt.Println("--- All TCP Endpoints ---")
+			} else {
+				fmt.Printf("--- Top %d TCP Endpoints ---\n", *top)
+			}
+			printEndpoints(firstN(tcpResults, *top), *format)
+		} else {
+			fmt.Println("No open TCP Endpoints were found.")
 		}
-	} else {
-		fmt.Println("No open TCP Endpoints were found.")
 	}
 
-	fmt.Println("\n--- UDP Results ---")
-	if len(udpResults) > 0 {
-		sort.Slice(udpResults, func(i, j int) bool {
-			return udpResults[i].Latency < udpResults[j].Latency
-		})
-		bestEndpoint := udpResults[0]
-		host, _, _ := net.SplitHostPort(bestEndpoint.Endpoint)
-		realPing := ipToPing[host]
-		fmt.Printf("🏆 Best UDP Endpoint: %s\n", bestEndpoint.Endpoint)
-		fmt.Printf("   Latency: %.2f ms (Real Ping: %.2f ms)\n\n", float64(bestEndpoint.Latency.Nanoseconds())/1e6, float64(realPing.Nanoseconds())/1e6)
+	if *proto != "tcp" && *view == "ranked" {
+		fmt.Println("\n--- UDP Results ---")
+		if len(udpResults) > 0 {
+			s.SortResults(udpResults)
+			if *groupByIP {
+				udpResults = bestPerIP(udpResults)
+			}
+			annotate(firstN(udpResults, *top))
+			if bestEndpoint := udpResults[0]; bestEndpoint.State != scanner.StateOpenFiltered {
+				fmt.Println(colors.best(fmt.Sprintf("%s Best UDP Endpoint: %s", bestBanner, bestEndpoint.Endpoint)))
+				fmt.Println(colors.best(fmt.Sprintf("   Latency: %.2f ms (Real Ping: %s%s)", float64(bestEndpoint.Latency.Nanoseconds())/1e6, formatPing(bestEndpoint.Ping), formatDetails(bestEndpoint))))
+			} else {
+				fmt.Println("No UDP endpoint answered. The ports below are only open|filtered.")
+			}
+			fmt.Println()
 
-		fmt.Println("--- Top 6 UDP Endpoints ---")
-		for i, result := range udpResults {
-			if i >= 6 {
-				break
+			if *top == 0 {
+				fmt.Println("--- All UDP Endpoints ---")
+			} else {
+				fmt.Printf("--- Top %d UDP Endpoints ---\n", *top)
 			}
-			host, _, _ := net.SplitHostPort(result.Endpoint)
-			realPing := ipToPing[host]
-			fmt.Printf("%d. Endpoint: %s (Latency: %.2f ms, Real Ping: %.2f ms)\n", i+1, result.Endpoint, float64(result.Latency.Nanoseconds())/1e6, float64(realPing.Nanoseconds())/1e6)
+			printEndpoints(firstN(udpResults, *top), *format)
+		} else if opts.Proxy != nil {
+			fmt.Println("UDP is not probed through -proxy.")
+		} else {
+			fmt.Println("No open UDP Endpoints were found.")
 		}
-	} else {
-		fmt.Println("No open UDP Endpoints were found.")
+	}
+	if *compare {
+		printComparison(tcpResults, answered(udpResults))
 	}
 	fmt.Println("\n(Latency is the connection time to the port. Real Ping is the ICMP echo time to the IP.)")
+
+	if *csvPath != "" {
+		var rows []scanner.EndpointResult
+		rows = append(rows, firstN(tcpResults, *top)...)
+		rows = append(rows, firstN(udpResults, *top)...)
+		if err := appendCSV(*csvPath, rows); err != nil {
+			logger.Error("could not write CSV", "path", *csvPath, "err", err)
+		}
+	}
+
+	if *cachePath != "" {
+		if err := saveCache(*cachePath, append(slices.Clone(tcpResults), udpResults...)); err != nil {
+			logger.Error("could not write cache", "path", *cachePath, "err", err)
+		}
+	}
+
+	configResults := answered(udpResults)
+	if *configProto == "tcp" {
+		configResults = tcpResults
+	}
+	if *emitConfig {
+		fmt.Println("\n--- WireGuard Config ---")
+		if len(configResults) > 0 {
+			fmt.Print(renderWireGuardPeer(configResults[0]))
+		} else {
+			fmt.Printf("No open %s endpoint to write into the config.\n", strings.ToUpper(*configProto))
+		}
+	}
+	if *clipboard && len(configResults) > 0 {
+		if err := copyToClipboard(configResults[0].Endpoint); err != nil {
+			fmt.Printf("\nCould not copy %s to the clipboard: %v\n", configResults[0].Endpoint, err)
+		} else {
+			fmt.Printf("\nCopied %s to the clipboard.\n", configResults[0].Endpoint)
+		}
+	}
+	return 0
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/monsmain/endpoint-scanner/scanner"
+)
+
+func endpointsOf(results []scanner.EndpointResult) []string {
+	var out []string
+	for _, result := range results {
+		out = append(out, result.Endpoint)
+	}
+	return out
+}
+
+func TestFirstN(t *testing.T) {
+	sorted := []scanner.EndpointResult{
+		{Endpoint: "10.0.0.2:80", Ping: scanner.PingResult{IP: "10.0.0.2"}},
+		{Endpoint: "10.0.0.2:443", Ping: scanner.PingResult{IP: "10.0.0.2"}},
+		{Endpoint: "10.0.0.1:443", Ping: scanner.PingResult{IP: "10.0.0.1"}},
+	}
+	tests := []struct {
+		name      string
+		top       int
+		groupByIP bool
+		want      []string
+	}{
+		{name: "top 0 keeps all", top: 0, want: []string{"10.0.0.2:80", "10.0.0.2:443", "10.0.0.1:443"}},
+		{name: "top 2", top: 2, want: []string{"10.0.0.2:80", "10.0.0.2:443"}},
+		{name: "top above count", top: 10, want: []string{"10.0.0.2:80", "10.0.0.2:443", "10.0.0.1:443"}},
+		{name: "best per IP", top: 0, groupByIP: true, want: []string{"10.0.0.2:80", "10.0.0.1:443"}},
+		{name: "best per IP, top 1", top: 1, groupByIP: true, want: []string{"10.0.0.2:80"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := sorted
+			if tt.groupByIP {
+				results = bestPerIP(results)
+			}
+			if got := endpointsOf(firstN(results, tt.top)); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnswered(t *testing.T) {
+	results := []scanner.EndpointResult{
+		{Endpoint: "10.0.0.1:2408", State: scanner.StateOpenFiltered},
+		{Endpoint: "10.0.0.2:2408"},
+		{Endpoint: "10.0.0.3:2408", State: scanner.StateOpenFiltered},
+		{Endpoint: "10.0.0.4:2408", Signature: "wireguard"},
+	}
+	want := []string{"10.0.0.2:2408", "10.0.0.4:2408"}
+	if got := endpointsOf(answered(results)); !slices.Equal(got, want) {
+		t.Errorf("answered = %v, want %v", got, want)
+	}
+	if len(results) != 4 || results[0].Endpoint != "10.0.0.1:2408" {
+		t.Errorf("answered modified its input: %v", endpointsOf(results))
+	}
+}
+
+func TestNormalizePorts(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []int
+		wantErr bool
+	}{
+		{name: "empty", value: "", want: nil},
+		{name: "only separators", value: " , ,", want: nil},
+		{name: "duplicates", value: "443,80,443,80", want: []int{80, 443}},
+		{name: "range", value: "2408,500-502", want: []int{500, 501, 502, 2408}},
+		{name: "overlapping ranges", value: "1-3,2-4,3", want: []int{1, 2, 3, 4}},
+		{name: "single-port range", value: "7-7", want: []int{7}},
+		{name: "zero", value: "0", wantErr: true},
+		{name: "above 65535", value: "65536", wantErr: true},
+		{name: "range end out of range", value: "65530-65540", wantErr: true},
+		{name: "reversed range", value: "10-5", wantErr: true},
+		{name: "not a number", value: "http", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ports, err := parsePorts(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePorts(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if got := normalizePorts(ports); !slices.Equal(got, tt.want) {
+				t.Errorf("normalizePorts(parsePorts(%q)) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
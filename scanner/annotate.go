@@ -0,0 +1,149 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var lookupAddr = net.DefaultResolver.LookupAddr
+
+// annotateConcurrency caps how many reverse lookups Annotate runs at once.
+const annotateConcurrency = 16
+
+type asnRange struct {
+	start, end netip.Addr
+	asn        int
+	org        string
+}
+
+// ASNDB maps IPs to the autonomous system announcing them, loaded from an
+// offline dataset.
+type ASNDB struct {
+	ranges []asnRange
+}
+
+// LoadASNDB reads a tab-separated IP-to-ASN dataset in the iptoasn.com
+// ip2asn format: range start, range end, AS number, country code and AS
+// description per line. Ranges with AS number 0 are not routed and are
+// skipped.
+func LoadASNDB(r io.Reader) (*ASNDB, error) {
+	db := &ASNDB{}
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: want start, end and AS number separated by tabs", lineNo)
+		}
+		start, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		end, err := netip.ParseAddr(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		asn, err := strconv.Atoi(fields[2])
+		if err != nil || asn < 0 {
+			return nil, fmt.Errorf("line %d: invalid AS number %q", lineNo, fields[2])
+		}
+		if asn == 0 {
+			continue
+		}
+		org := ""
+		if len(fields) >= 5 {
+			org = fields[4]
+		}
+		db.ranges = append(db.ranges, asnRange{start: start.Unmap(), end: end.Unmap(), asn: asn, org: org})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return db.ranges[i].start.Less(db.ranges[j].start)
+	})
+	return db, nil
+}
+
+// Lookup returns the AS number and organisation announcing ip.
+func (db *ASNDB) Lookup(ip string) (int, string, bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return 0, "", false
+	}
+	addr = addr.Unmap()
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return addr.Less(db.ranges[i].start)
+	})
+	if i == 0 {
+		return 0, "", false
+	}
+	r := db.ranges[i-1]
+	if r.end.Less(addr) || r.start.Is4() != addr.Is4() {
+		return 0, "", false
+	}
+	return r.asn, r.org, true
+}
+
+// Annotate fills in ReverseDNS and, when asn is not nil, ASN and ASOrg on
+// every result. Each IP is looked up once, with at most timeout per
+// reverse lookup; a zero timeout skips reverse lookups.
+func Annotate(ctx context.Context, results []EndpointResult, asn *ASNDB, timeout time.Duration) {
+	var ips []string
+	if timeout > 0 {
+		seen := make(map[string]bool)
+		for _, result := range results {
+			if ip, _ := splitEndpoint(result.Endpoint); !seen[ip] {
+				seen[ip] = true
+				ips = append(ips, ip)
+			}
+		}
+	}
+
+	// Each lookup writes only its own slot of found.
+	found := make([]string, len(ips))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, annotateConcurrency)
+	for i, ip := range ips {
+		if !acquire(ctx, sem) {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			lookupCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			hosts, err := lookupAddr(lookupCtx, ip)
+			if err != nil || len(hosts) == 0 {
+				return
+			}
+			found[i] = strings.TrimSuffix(hosts[0], ".")
+		}()
+	}
+	wg.Wait()
+	names := make(map[string]string, len(ips))
+	for i, ip := range ips {
+		names[ip] = found[i]
+	}
+
+	for i := range results {
+		ip, _ := splitEndpoint(results[i].Endpoint)
+		results[i].ReverseDNS = names[ip]
+		if asn != nil {
+			results[i].ASN, results[i].ASOrg, _ = asn.Lookup(ip)
+		}
+	}
+}
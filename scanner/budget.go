@@ -0,0 +1,54 @@
+package scanner
+
+import "errors"
+
+var errBudgetSpent = errors.New("probe budget spent")
+
+// pingBudget is how much of Options.MaxProbes pings may use, leaving the
+// rest for port probes of the IPs that answer.
+func (s *Scanner) pingBudget() int {
+	return (s.opts.MaxProbes + 1) / 2
+}
+
+// spend counts one ping or port probe against Options.MaxProbes, failing
+// once the budget for it is used up.
+func (s *Scanner) spend(ping bool) bool {
+	if s.opts.MaxProbes == 0 {
+		return true
+	}
+	s.budgetMu.Lock()
+	defer s.budgetMu.Unlock()
+	if s.exhaustedLocked(ping) {
+		return false
+	}
+	s.issued++
+	if ping {
+		s.pingsIssued++
+	}
+	return true
+}
+
+// outOfBudget reports whether another ping or port probe would fail spend.
+func (s *Scanner) outOfBudget(ping bool) bool {
+	if s.opts.MaxProbes == 0 {
+		return false
+	}
+	s.budgetMu.Lock()
+	defer s.budgetMu.Unlock()
+	return s.exhaustedLocked(ping)
+}
+
+func (s *Scanner) exhaustedLocked(ping bool) bool {
+	if s.issued < s.opts.MaxProbes && (!ping || s.pingsIssued < s.pingBudget()) {
+		return false
+	}
+	s.budgetSpent = true
+	return true
+}
+
+// BudgetSpent reports whether Options.MaxProbes stopped any ping or probe.
+func (s *Scanner) BudgetSpent() bool {
+	s.budgetMu.Lock()
+	defer s.budgetMu.Unlock()
+	return s.budgetSpent
+}
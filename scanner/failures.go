@@ -0,0 +1,63 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// FailureClasses lists the classes Failures counts, in display order.
+var FailureClasses = []string{"timeouts", "refused", "unreachable", "permission denied", "no reply", "other"}
+
+// ClassifyFailure puts a failed probe's error into one of FailureClasses.
+// UDP probes that got no answer count as "no reply" rather than timeouts.
+func ClassifyFailure(err error) string {
+	switch {
+	case errors.Is(err, errNoHandshake), errors.Is(err, errNoEcho), errors.Is(err, errNoPayloadReply):
+		return "no reply"
+	case errors.Is(err, errPortUnreachable):
+		return "refused"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, errPastDeadline):
+		return "timeouts"
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.ECONNREFUSED:
+			return "refused"
+		case syscall.ENETUNREACH, syscall.EHOSTUNREACH:
+			return "unreachable"
+		case syscall.EACCES, syscall.EPERM:
+			return "permission denied"
+		}
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Timeout() {
+		return "timeouts"
+	}
+	return "other"
+}
+
+func (s *Scanner) recordFailure(err error) {
+	class := ClassifyFailure(err)
+	s.failuresMu.Lock()
+	defer s.failuresMu.Unlock()
+	if s.failures == nil {
+		s.failures = make(map[string]int)
+	}
+	s.failures[class]++
+}
+
+// Failures counts the port probes that failed after all retries, keyed by
+// the classes in FailureClasses. Probes stopped by cancellation or
+// Options.MaxProbes are not counted.
+func (s *Scanner) Failures() map[string]int {
+	s.failuresMu.Lock()
+	defer s.failuresMu.Unlock()
+	failures := make(map[string]int, len(s.failures))
+	for class, n := range s.failures {
+		failures[class] = n
+	}
+	return failures
+}
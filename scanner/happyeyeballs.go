@@ -0,0 +1,67 @@
+package scanner
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// happyEyeballsDelay is the RFC 8305 connection attempt delay: how long
+// the IPv6 attempt runs alone before IPv4 joins the race.
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// RaceFamilies probes TCP port on v6 and, after happyEyeballsDelay or as
+// soon as v6 fails, on v4, keeping whichever succeeds first and cancelling
+// the other. The winner's Family is "ipv6" or "ipv4".
+func (s *Scanner) RaceFamilies(ctx context.Context, v4, v6 string, port int) (EndpointResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type attempt struct {
+		result EndpointResult
+		err    error
+	}
+	attempts := make(chan attempt, 2)
+	start := func(ip string) {
+		go func() {
+			result, err := s.probe(ctx, PingResult{IP: ip}, port, "tcp")
+			attempts <- attempt{result, err}
+		}()
+	}
+	start(v6)
+	started, failed := 1, 0
+	delay := time.NewTimer(happyEyeballsDelay)
+	defer delay.Stop()
+
+	for {
+		select {
+		case <-delay.C:
+			if started == 1 {
+				start(v4)
+				started++
+			}
+		case a := <-attempts:
+			if a.err == nil {
+				a.result.Family = ipFamily(a.result.Endpoint)
+				return a.result, nil
+			}
+			failed++
+			if started == 1 {
+				start(v4)
+				started++
+			} else if failed == started {
+				return EndpointResult{}, a.err
+			}
+		case <-ctx.Done():
+			return EndpointResult{}, ctx.Err()
+		}
+	}
+}
+
+func ipFamily(endpoint string) string {
+	host, _ := splitEndpoint(endpoint)
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return "ipv6"
+	}
+	return "ipv4"
+}
@@ -0,0 +1,84 @@
+package scanner
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// probeHTTP sends a GET for Options.HTTPPath to address, dialling the
+// target IP whatever the Host header says. Only 2xx and 3xx responses count
+// as healthy.
+func (s *Scanner) probeHTTP(ctx context.Context, network, address string, port int, timeout time.Duration, result EndpointResult) (EndpointResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	scheme := "http"
+	if s.tlsPorts[port] {
+		scheme = "https"
+	}
+	host := address
+	if s.opts.TLSServerName != "" {
+		host = net.JoinHostPort(s.opts.TLSServerName, strconv.Itoa(port))
+	}
+	target := url.URL{Scheme: scheme, Host: host, Path: s.opts.HTTPPath}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return s.dialer.DialContext(ctx, network, address)
+		},
+		TLSClientConfig: &tls.Config{
+			ServerName:         s.opts.TLSServerName,
+			InsecureSkipVerify: true,
+		},
+		DisableKeepAlives: true,
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	var start, connected, firstByte time.Time
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			connected = time.Now()
+			result.LocalAddr = info.Conn.LocalAddr().String()
+			s.recordRemote(&result, info.Conn)
+		},
+		GotFirstResponseByte: func() { firstByte = time.Now() },
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, target.String(), nil)
+	if err != nil {
+		return result, err
+	}
+
+	start = time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return result, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	result.Latency = connected.Sub(start)
+	result.TTFB = firstByte.Sub(start)
+	result.HTTPStatus = resp.StatusCode
+	if resp.TLS != nil {
+		result.TLSVersion = tls.VersionName(resp.TLS.Version)
+		result.TLSCipher = tls.CipherSuiteName(resp.TLS.CipherSuite)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return result, fmt.Errorf("unhealthy HTTP status %d", resp.StatusCode)
+	}
+	return result, nil
+}
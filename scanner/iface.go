@@ -0,0 +1,66 @@
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// boundDialer dials from the IPv4 or IPv6 address of one network interface,
+// matching the family of the network being dialled.
+type boundDialer struct {
+	v4, v6 net.IP
+}
+
+func bindInterface(name string) (*boundDialer, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %w", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %w", name, err)
+	}
+	d := &boundDialer{}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			if d.v4 == nil {
+				d.v4 = ip4
+			}
+		} else if d.v6 == nil && !ipNet.IP.IsLinkLocalUnicast() {
+			d.v6 = ipNet.IP
+		}
+	}
+	if d.v4 == nil && d.v6 == nil {
+		return nil, fmt.Errorf("interface %s has no usable IP address", name)
+	}
+	return d, nil
+}
+
+func (d *boundDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	ip := d.v4
+	if strings.HasSuffix(network, "6") || ip == nil {
+		ip = d.v6
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("no local address for %s", network)
+	}
+
+	var dialer net.Dialer
+	if strings.HasPrefix(network, "udp") {
+		dialer.LocalAddr = &net.UDPAddr{IP: ip}
+	} else {
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// Dial lets a boundDialer forward SOCKS5 proxy connections.
+func (d *boundDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
@@ -0,0 +1,100 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// portDialer dials from source ports taken round-robin from a fixed pool,
+// optionally on the addresses of a boundDialer. Each port stays out of the
+// pool until its connection is closed, so dials wait when all are in use.
+type portDialer struct {
+	bound  *boundDialer
+	ports  chan int
+	logger *slog.Logger
+}
+
+func newPortDialer(bound *boundDialer, ports []int, logger *slog.Logger) *portDialer {
+	d := &portDialer{bound: bound, ports: make(chan int, len(ports)), logger: logger}
+	for _, port := range ports {
+		d.ports <- port
+	}
+	return d
+}
+
+// DialContext skips ports the OS still holds, e.g. in TIME_WAIT. Only the
+// first port is waited for; the skipped ones are held until the dial ends
+// so each free port is tried at most once.
+func (d *portDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var ip net.IP
+	if d.bound != nil {
+		ip = d.bound.v4
+		if strings.HasSuffix(network, "6") || ip == nil {
+			ip = d.bound.v6
+		}
+	}
+
+	var held []int
+	defer func() {
+		for _, port := range held {
+			d.ports <- port
+		}
+	}()
+	var err error
+	for {
+		var port int
+		if len(held) == 0 {
+			select {
+			case port = <-d.ports:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		} else {
+			select {
+			case port = <-d.ports:
+			default:
+				return nil, err
+			}
+		}
+		var dialer net.Dialer
+		if strings.HasPrefix(network, "udp") {
+			dialer.LocalAddr = &net.UDPAddr{IP: ip, Port: port}
+		} else {
+			dialer.LocalAddr = &net.TCPAddr{IP: ip, Port: port}
+		}
+		d.logger.Debug("dialing from local port", "network", network, "address", address, "local_port", port)
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network, address)
+		if err == nil {
+			return &portConn{Conn: conn, release: func() { d.ports <- port }}, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			d.ports <- port
+			return nil, err
+		}
+		held = append(held, port)
+	}
+}
+
+// Dial lets a portDialer forward SOCKS5 proxy connections.
+func (d *portDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// portConn returns its source port to the pool when closed.
+type portConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *portConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
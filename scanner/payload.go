@@ -0,0 +1,69 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+var errNoPayloadReply = errors.New("no reply to probe payload")
+
+// probePayload sends Options.ProbeSend to address and, with ProbeExpect
+// set, records in result.Signature whether the reply starts with it. A TCP
+// port counts as open once connected, a UDP port only if it replies.
+func (s *Scanner) probePayload(ctx context.Context, network, address string, timeout time.Duration, result EndpointResult) (EndpointResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	tcp := strings.HasPrefix(network, "tcp")
+
+	start := time.Now()
+	conn, err := s.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return result, err
+	}
+	defer conn.Close()
+	if tcp {
+		result.Latency = time.Since(start)
+	}
+	result.LocalAddr = conn.LocalAddr().String()
+	s.recordRemote(&result, conn)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	sent := time.Now()
+	if _, err := conn.Write(s.opts.ProbeSend); err != nil {
+		return result, err
+	}
+	expect := s.opts.ProbeExpect
+	if tcp && len(expect) == 0 {
+		return result, nil
+	}
+
+	reply := make([]byte, max(len(expect), 1500))
+	var n int
+	if tcp {
+		n, err = io.ReadAtLeast(conn, reply, len(expect))
+	} else {
+		n, err = conn.Read(reply)
+		if err != nil {
+			if ctx.Err() != nil && !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return result, ctx.Err()
+			}
+			return result, errNoPayloadReply
+		}
+		result.Latency = time.Since(sent)
+	}
+	if len(expect) > 0 {
+		result.Signature = "mismatch"
+		if bytes.HasPrefix(reply[:n], expect) {
+			result.Signature = "match"
+		}
+	}
+	return result, nil
+}
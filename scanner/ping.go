@@ -0,0 +1,341 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var errRawSocketDenied = errors.New("raw ICMP sockets are not permitted")
+
+var errPingTimedOut = errors.New("ping timed out")
+
+// canPing reports whether the ping command at path or raw ICMP sockets are
+// available.
+func canPing(path string) bool {
+	if _, err := exec.LookPath(path); err == nil {
+		return true
+	}
+	return rawICMPAllowed()
+}
+
+// rawICMPAllowed reports whether raw ICMP sockets can be opened. It is
+// checked once per process.
+var rawICMPAllowed = sync.OnceValue(func() bool {
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return !errors.Is(err, os.ErrPermission)
+	}
+	conn.Close()
+	return true
+})
+
+var noPingWarning sync.Once
+
+// pingKillSlack is added to the expected run time of the ping command
+// before it is killed.
+const pingKillSlack = 2 * time.Second
+
+type pingCommand struct {
+	args      func(ip string, count int, timeout time.Duration) []string
+	rttRegex  *regexp.Regexp
+	lossRegex *regexp.Regexp
+}
+
+// summaryRTTRegex matches the Linux "rtt min/avg/max/mdev" line as well as
+// the BSD, macOS and BusyBox "round-trip" variants with or without stddev.
+var summaryRTTRegex = regexp.MustCompile(`(?:rtt|round-trip) min/avg/max(?:/(?:mdev|stddev))? = [\d.]+/(?P<avg>[\d.]+)/[\d.]+(?:/(?P<jitter>[\d.]+))? ?ms`)
+
+// replyTimeRegex matches the per-reply "time=12.3 ms" (or Windows
+// "time<1ms") used when no summary line can be parsed.
+var replyTimeRegex = regexp.MustCompile(`time[=<](?P<ms>[\d.]+) ?ms`)
+
+var pingStyles = map[string]pingCommand{
+	"unix": {
+		args: func(ip string, count int, timeout time.Duration) []string {
+			if runtime.GOOS == "darwin" {
+				return []string{"-c", strconv.Itoa(count), "-W", strconv.FormatInt(timeout.Milliseconds(), 10), ip}
+			}
+			return []string{"-c", strconv.Itoa(count), "-W", strconv.Itoa(int(math.Ceil(timeout.Seconds()))), ip}
+		},
+		rttRegex:  summaryRTTRegex,
+		lossRegex: regexp.MustCompile(`(?P<sent>\d+) packets transmitted, (?P<received>\d+) (?:packets )?received`),
+	},
+	"busybox": {
+		args: func(ip string, count int, timeout time.Duration) []string {
+			return []string{"-c", strconv.Itoa(count), "-W", strconv.Itoa(int(math.Ceil(timeout.Seconds()))), ip}
+		},
+		rttRegex:  summaryRTTRegex,
+		lossRegex: regexp.MustCompile(`(?P<sent>\d+) packets transmitted, (?P<received>\d+) packets received`),
+	},
+	"windows": {
+		args: func(ip string, count int, timeout time.Duration) []string {
+			return []string{"-n", strconv.Itoa(count), "-w", strconv.FormatInt(timeout.Milliseconds(), 10), ip}
+		},
+		rttRegex:  regexp.MustCompile(`Average = (?P<avg>\d+)ms`),
+		lossRegex: regexp.MustCompile(`Sent = (?P<sent>\d+), Received = (?P<received>\d+)`),
+	},
+}
+
+// DefaultPingStyle picks the flavour of the ping on PATH for the current
+// platform.
+func DefaultPingStyle() string {
+	return PingStyleOf("ping")
+}
+
+// PingStyleOf picks the flavour of the ping command at path, a name on
+// PATH or a file, for the current platform, detecting BusyBox by following
+// its symlink.
+func PingStyleOf(path string) string {
+	if runtime.GOOS == "windows" {
+		return "windows"
+	}
+	if path, err := exec.LookPath(path); err == nil {
+		if target, err := filepath.EvalSymlinks(path); err == nil && filepath.Base(target) == "busybox" {
+			return "busybox"
+		}
+	}
+	return "unix"
+}
+
+func submatch(re *regexp.Regexp, matches []string, name string) string {
+	if i := re.SubexpIndex(name); i >= 0 && i < len(matches) {
+		return matches[i]
+	}
+	return ""
+}
+
+// pingWithTermux runs the system ping command. It is killed once it runs
+// well past count replies at one per second (or per timeout, if longer), so
+// a ping stuck on a stalled route cannot pile up across big or watch runs.
+func pingWithTermux(ctx context.Context, ipAddr, path string, style pingCommand, count int, timeout time.Duration) (PingResult, error) {
+	runCtx, cancel := context.WithTimeout(ctx, time.Duration(count)*max(timeout, time.Second)+pingKillSlack)
+	defer cancel()
+
+	cmd := exec.CommandContext(runCtx, path, style.args(ipAddr, count, timeout)...)
+	cmd.WaitDelay = time.Second
+	stdout, stdoutWriter := io.Pipe()
+	cmd.Stdout = stdoutWriter
+	if err := cmd.Start(); err != nil {
+		return PingResult{}, err
+	}
+
+	type output struct {
+		result PingResult
+		parsed bool
+	}
+	done := make(chan output, 1)
+	go func() {
+		result, parsed := parsePingOutput(stdout, style, ipAddr, count)
+		io.Copy(io.Discard, stdout)
+		done <- output{result, parsed}
+	}()
+	err := cmd.Wait()
+	stdoutWriter.Close()
+	out := <-done
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return PingResult{}, ctx.Err()
+		}
+		if runCtx.Err() != nil {
+			return PingResult{}, errPingTimedOut
+		}
+		return PingResult{}, fmt.Errorf("no response from host")
+	}
+	if !out.parsed {
+		return PingResult{}, fmt.Errorf("could not parse RTT")
+	}
+	return out.result, nil
+}
+
+// parsePingOutput reads the RTT, jitter and loss from ping output. Without
+// a summary line it averages the per-reply times instead.
+func parsePingOutput(r io.Reader, style pingCommand, ipAddr string, count int) (PingResult, bool) {
+	scanner := bufio.NewScanner(r)
+	result := PingResult{IP: ipAddr}
+	rttFound, lossFound := false, false
+	var replies []time.Duration
+	for scanner.Scan() {
+		line := scanner.Text()
+		if matches := replyTimeRegex.FindStringSubmatch(line); matches != nil {
+			if ms, err := strconv.ParseFloat(submatch(replyTimeRegex, matches, "ms"), 64); err == nil {
+				replies = append(replies, time.Duration(ms*float64(time.Millisecond)))
+			}
+		}
+		if matches := style.rttRegex.FindStringSubmatch(line); matches != nil {
+			avg, err := strconv.ParseFloat(submatch(style.rttRegex, matches, "avg"), 64)
+			if err == nil {
+				result.RTT = time.Duration(avg * float64(time.Millisecond))
+				rttFound = true
+			}
+			jitter, err := strconv.ParseFloat(submatch(style.rttRegex, matches, "jitter"), 64)
+			if err == nil {
+				result.Jitter = time.Duration(jitter * float64(time.Millisecond))
+			}
+		}
+		if matches := style.lossRegex.FindStringSubmatch(line); matches != nil {
+			transmitted, _ := strconv.Atoi(submatch(style.lossRegex, matches, "sent"))
+			received, _ := strconv.Atoi(submatch(style.lossRegex, matches, "received"))
+			if transmitted > 0 {
+				result.Loss = float64(transmitted-received) / float64(transmitted) * 100
+				lossFound = true
+			}
+		}
+	}
+	if rttFound {
+		return result, true
+	}
+	if len(replies) == 0 {
+		return PingResult{}, false
+	}
+	fallback := pingStats(ipAddr, replies, count)
+	if lossFound {
+		fallback.Loss = result.Loss
+	}
+	return fallback, true
+}
+
+func pingStats(ip string, rtts []time.Duration, sent int) PingResult {
+	result := PingResult{IP: ip}
+	if sent > 0 {
+		result.Loss = float64(sent-len(rtts)) / float64(sent) * 100
+	}
+	if len(rtts) == 0 {
+		return result
+	}
+
+	var total time.Duration
+	for _, rtt := range rtts {
+		total += rtt
+	}
+	result.RTT = total / time.Duration(len(rtts))
+	if len(rtts) < 2 {
+		return result
+	}
+
+	var variance float64
+	for _, rtt := range rtts {
+		diff := float64(rtt - result.RTT)
+		variance += diff * diff
+	}
+	result.Jitter = time.Duration(math.Sqrt(variance / float64(len(rtts))))
+	return result
+}
+
+func pingNative(ctx context.Context, ip string, count int, timeout time.Duration) (PingResult, error) {
+	dst := net.ParseIP(ip)
+	if dst == nil {
+		return PingResult{}, fmt.Errorf("invalid IP address %q", ip)
+	}
+
+	network, listenAddr, protocol := "ip4:icmp", "0.0.0.0", 1
+	var echoType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	if dst.To4() == nil {
+		network, listenAddr, protocol = "ip6:ipv6-icmp", "::", 58
+		echoType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+
+	conn, err := icmp.ListenPacket(network, listenAddr)
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return PingResult{}, errRawSocketDenied
+		}
+		return PingResult{}, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	id := rand.Intn(0xffff)
+	buf := make([]byte, 1500)
+	var rtts []time.Duration
+	for seq := 1; seq <= count && ctx.Err() == nil; seq++ {
+		msg := icmp.Message{
+			Type: echoType,
+			Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("endpoint-scanner")},
+		}
+		packet, err := msg.Marshal(nil)
+		if err != nil {
+			return PingResult{}, err
+		}
+
+		start := time.Now()
+		if _, err := conn.WriteTo(packet, &net.IPAddr{IP: dst}); err != nil {
+			return PingResult{}, err
+		}
+		if err := conn.SetReadDeadline(start.Add(timeout)); err != nil {
+			return PingResult{}, err
+		}
+		for {
+			n, peer, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			reply, err := icmp.ParseMessage(protocol, buf[:n])
+			if err != nil || reply.Type != replyType {
+				continue
+			}
+			echo, ok := reply.Body.(*icmp.Echo)
+			if !ok || echo.ID != id || echo.Seq != seq {
+				continue
+			}
+			if peerAddr, ok := peer.(*net.IPAddr); ok && !peerAddr.IP.Equal(dst) {
+				continue
+			}
+			rtts = append(rtts, time.Since(start))
+			break
+		}
+	}
+
+	if ctx.Err() != nil {
+		return PingResult{}, ctx.Err()
+	}
+	if len(rtts) == 0 {
+		return PingResult{}, fmt.Errorf("no response from host")
+	}
+	return pingStats(ip, rtts, count), nil
+}
+
+// Pinger measures the round trip to an IP. Options.Pinger replaces the
+// default ICMP pinger, e.g. with a fake in tests.
+type Pinger interface {
+	Ping(ctx context.Context, ip string) (PingResult, error)
+}
+
+// systemPinger sends ICMP echo requests itself and falls back to the ping
+// command when raw sockets are not permitted.
+type systemPinger struct {
+	path    string
+	command pingCommand
+	count   int
+	timeout time.Duration
+	logger  *slog.Logger
+}
+
+func (p systemPinger) Ping(ctx context.Context, ipAddr string) (PingResult, error) {
+	result, err := pingNative(ctx, ipAddr, p.count, p.timeout)
+	if errors.Is(err, errRawSocketDenied) {
+		p.logger.Debug("raw ICMP denied, falling back to system ping", "ip", ipAddr)
+		return pingWithTermux(ctx, ipAddr, p.path, p.command, p.count, p.timeout)
+	}
+	return result, err
+}
@@ -0,0 +1,118 @@
+package scanner
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+const linuxPing = `PING 162.159.192.1 (162.159.192.1) 56(84) bytes of data.
+64 bytes from 162.159.192.1: icmp_seq=1 ttl=57 time=12.4 ms
+64 bytes from 162.159.192.1: icmp_seq=2 ttl=57 time=11.9 ms
+64 bytes from 162.159.192.1: icmp_seq=3 ttl=57 time=12.8 ms
+
+--- 162.159.192.1 ping statistics ---
+3 packets transmitted, 3 received, 0% packet loss, time 2003ms
+rtt min/avg/max/mdev = 11.912/12.367/12.801/0.363 ms
+`
+
+const macOSPing = `PING 162.159.192.1 (162.159.192.1): 56 data bytes
+64 bytes from 162.159.192.1: icmp_seq=0 ttl=57 time=14.210 ms
+64 bytes from 162.159.192.1: icmp_seq=1 ttl=57 time=13.874 ms
+Request timeout for icmp_seq 2
+
+--- 162.159.192.1 ping statistics ---
+3 packets transmitted, 2 packets received, 33.3% packet loss
+round-trip min/avg/max/stddev = 13.874/14.042/14.210/0.168 ms
+`
+
+const busyboxPing = `PING 162.159.192.1 (162.159.192.1): 56 data bytes
+64 bytes from 162.159.192.1: seq=0 ttl=57 time=15.123 ms
+64 bytes from 162.159.192.1: seq=1 ttl=57 time=14.877 ms
+64 bytes from 162.159.192.1: seq=2 ttl=57 time=15.001 ms
+
+--- 162.159.192.1 ping statistics ---
+3 packets transmitted, 3 packets received, 0% packet loss
+round-trip min/avg/max = 14.877/15.000/15.123 ms
+`
+
+// killedPing was cut off before the summary, e.g. by pingKillSlack.
+const killedPing = `PING 162.159.192.1 (162.159.192.1) 56(84) bytes of data.
+64 bytes from 162.159.192.1: icmp_seq=1 ttl=57 time=10.0 ms
+64 bytes from 162.159.192.1: icmp_seq=3 ttl=57 time=20.0 ms
+`
+
+// noSummaryRTTPing has a loss line but an RTT summary no pattern knows.
+const noSummaryRTTPing = `PING 162.159.192.1 (162.159.192.1) 56(84) bytes of data.
+64 bytes from 162.159.192.1: icmp_seq=1 ttl=57 time=10.0 ms
+64 bytes from 162.159.192.1: icmp_seq=2 ttl=57 time=20.0 ms
+
+--- 162.159.192.1 ping statistics ---
+2 packets transmitted, 2 received, 0% packet loss, time 1001ms
+round trip (ms) 10.0 15.0 20.0
+`
+
+const windowsPing = `
+Pinging 162.159.192.1 with 32 bytes of data:
+Reply from 162.159.192.1: bytes=32 time=13ms TTL=57
+Reply from 162.159.192.1: bytes=32 time=11ms TTL=57
+Reply from 162.159.192.1: bytes=32 time=12ms TTL=57
+
+Ping statistics for 162.159.192.1:
+    Packets: Sent = 3, Received = 3, Lost = 0 (0% loss),
+Approximate round trip times in milli-seconds:
+    Minimum = 11ms, Maximum = 13ms, Average = 12ms
+`
+
+const unreachablePing = `PING 162.159.192.1 (162.159.192.1) 56(84) bytes of data.
+
+--- 162.159.192.1 ping statistics ---
+3 packets transmitted, 0 received, 100% packet loss, time 2030ms
+`
+
+func TestParsePingOutput(t *testing.T) {
+	ms := func(f float64) time.Duration { return time.Duration(f * float64(time.Millisecond)) }
+	tests := []struct {
+		name       string
+		style      string
+		output     string
+		count      int
+		wantOK     bool
+		wantRTT    time.Duration
+		wantJitter time.Duration
+		wantLoss   float64
+	}{
+		{name: "linux", style: "unix", output: linuxPing, count: 3, wantOK: true, wantRTT: ms(12.367), wantJitter: ms(0.363)},
+		{name: "macOS", style: "unix", output: macOSPing, count: 3, wantOK: true, wantRTT: ms(14.042), wantJitter: ms(0.168), wantLoss: 100.0 / 3},
+		{name: "busybox", style: "busybox", output: busyboxPing, count: 3, wantOK: true, wantRTT: ms(15)},
+		{name: "windows", style: "windows", output: windowsPing, count: 3, wantOK: true, wantRTT: ms(12)},
+		{name: "per-reply fallback", style: "unix", output: killedPing, count: 3, wantOK: true, wantRTT: ms(15), wantJitter: ms(5), wantLoss: 100.0 / 3},
+		{name: "per-reply fallback keeps reported loss", style: "unix", output: noSummaryRTTPing, count: 3, wantOK: true, wantRTT: ms(15), wantJitter: ms(5)},
+		{name: "no replies", style: "unix", output: unreachablePing, count: 3},
+		{name: "empty", style: "busybox", output: "", count: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parsePingOutput(strings.NewReader(tt.output), pingStyles[tt.style], "162.159.192.1", tt.count)
+			if ok != tt.wantOK {
+				t.Fatalf("parsed = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if got.IP != "162.159.192.1" {
+				t.Errorf("IP = %q", got.IP)
+			}
+			if got.RTT.Round(time.Microsecond) != tt.wantRTT.Round(time.Microsecond) {
+				t.Errorf("RTT = %v, want %v", got.RTT, tt.wantRTT)
+			}
+			if got.Jitter.Round(time.Microsecond) != tt.wantJitter.Round(time.Microsecond) {
+				t.Errorf("Jitter = %v, want %v", got.Jitter, tt.wantJitter)
+			}
+			if math.Abs(got.Loss-tt.wantLoss) > 0.01 {
+				t.Errorf("Loss = %.2f%%, want %.2f%%", got.Loss, tt.wantLoss)
+			}
+		})
+	}
+}
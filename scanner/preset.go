@@ -0,0 +1,31 @@
+package scanner
+
+// Preset is the address space and ports of one provider's endpoints.
+type Preset struct {
+	Description string
+	// IPv4Subnets are /24s written as their first three octets, like
+	// Options.IPv4Subnets.
+	IPv4Subnets  []string
+	IPv6Prefixes []string
+	TCPPorts     []int
+	UDPPorts     []int
+}
+
+// DefaultPreset names the preset DefaultOptions scans.
+const DefaultPreset = "cloudflare-warp"
+
+var cloudflareWARP = Preset{
+	Description: "Cloudflare WARP WireGuard endpoints",
+	IPv4Subnets: []string{
+		"162.159.192.", "162.159.193.", "162.159.195.",
+		"188.114.96.", "188.114.97.", "188.114.98.", "188.114.99.",
+	},
+	IPv6Prefixes: []string{"2606:4700:d0::/64", "2606:4700:d1::/64"},
+	TCPPorts:     []int{443, 8886, 908, 8854, 4198, 955, 988, 3854, 894, 7156, 1074, 939, 864, 854, 1070, 3476, 1387, 7559, 890, 1018},
+	UDPPorts:     []int{500, 1701, 4500, 2408, 878, 2371},
+}
+
+// Presets maps preset names to their Preset.
+var Presets = map[string]Preset{
+	DefaultPreset: cloudflareWARP,
+}
@@ -0,0 +1,46 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runProbeCommand runs Options.ProbeCommand for an endpoint that opened and
+// replaces its latency with the milliseconds the command prints. A non-zero
+// exit or unparsable output fails the probe.
+func (s *Scanner) runProbeCommand(ctx context.Context, result EndpointResult, timeout time.Duration) (EndpointResult, error) {
+	host, port, err := net.SplitHostPort(result.Endpoint)
+	if err != nil {
+		return result, err
+	}
+	placeholders := strings.NewReplacer("{ip}", host, "{port}", port, "{proto}", result.Protocol)
+	args := make([]string, len(s.opts.ProbeCommand))
+	for i, arg := range s.opts.ProbeCommand {
+		args[i] = placeholders.Replace(arg)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.WaitDelay = time.Second
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return result, fmt.Errorf("probe command: %w", ctx.Err())
+		}
+		return result, fmt.Errorf("probe command: %w", err)
+	}
+	ms, err := strconv.ParseFloat(strings.TrimSpace(stdout.String()), 64)
+	if err != nil || ms < 0 {
+		return result, fmt.Errorf("probe command printed %q, want a latency in ms", strings.TrimSpace(stdout.String()))
+	}
+	result.Latency = time.Duration(ms * float64(time.Millisecond))
+	return result, nil
+}
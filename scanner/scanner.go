@@ -0,0 +1,1349 @@
+// Package scanner finds low-latency endpoints by pinging candidate IPs and
+// probing TCP and UDP ports on the ones that respond.
+package scanner
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+var (
+	DefaultTCPPorts = cloudflareWARP.TCPPorts
+	DefaultUDPPorts = cloudflareWARP.UDPPorts
+)
+
+type PingResult struct {
+	IP     string
+	RTT    time.Duration
+	Jitter time.Duration
+	Loss   float64
+}
+
+type EndpointResult struct {
+	// Endpoint is the address the successful connection reached. Target
+	// is the ip:port that was probed, which Endpoint normally equals.
+	Endpoint   string
+	Target     string
+	Latency    time.Duration
+	Protocol   string
+	Ping       PingResult
+	TLSVersion string
+	TLSCipher  string
+	// HTTPStatus is set for ports probed with Options.HTTPPath. TTFB is
+	// the time to the first byte of the HTTP response there, or of any
+	// data for plain TCP probes made with Options.TTFBWait.
+	HTTPStatus int
+	TTFB       time.Duration
+	// LocalAddr is the source address of the connection that succeeded.
+	LocalAddr string
+	// MinLatency is the fastest of Options.Samples probes, whose median
+	// becomes Latency. It stays zero for single-sample scans.
+	MinLatency time.Duration
+	// Hostname is the name the IP was resolved from, if any.
+	Hostname string
+	// ConnectLatency is the handshake time of probes made with
+	// Options.TTFBWait, whose Latency is the time to the first byte.
+	ConnectLatency time.Duration
+	// AppRTT is the time from writing a byte after connecting to the
+	// server's answer, for probes made with Options.AppRTTWait.
+	AppRTT time.Duration
+	// KernelRTT and MSS are the kernel's smoothed RTT and send MSS for the
+	// connection, for probes made with Options.TCPInfo.
+	KernelRTT time.Duration
+	MSS       int
+	// CloseLatency is the time from half-closing the connection to the
+	// peer's FIN or RST, and PeerClose which of the two ("fin" or "rst")
+	// it sent, for probes made with Options.CloseWait.
+	CloseLatency time.Duration
+	PeerClose    string
+	// Family is "ipv4" or "ipv6" for the winner of Scanner.RaceFamilies.
+	Family string
+	// Signature is "match" or "mismatch" for ports probed with
+	// Options.ProbeExpect, depending on the reply.
+	Signature string
+	// State is StateOpenFiltered for icmp-mode UDP ports that stayed
+	// silent, and empty for endpoints that answered.
+	State string
+	// ReverseDNS, ASN and ASOrg are filled in by Annotate.
+	ReverseDNS string
+	ASN        int
+	ASOrg      string
+}
+
+// Weights control how ScoreEndpoint combines connect latency, ping RTT,
+// ping jitter and ping loss into a single ranking score.
+type Weights struct {
+	Latency float64
+	Ping    float64
+	Jitter  float64
+	Loss    float64
+}
+
+// DefaultWeights charge 1 point per ms of connect latency, 2 points per ms
+// of jitter and 10 points per percent of packet loss, so 10% loss outweighs
+// 100 ms of extra latency. Ping RTT is not charged by default.
+var DefaultWeights = Weights{Latency: 1, Jitter: 2, Loss: 10}
+
+// Options holds the tunables for target generation, pinging and port
+// scanning. Zero values fall back to the defaults from DefaultOptions,
+// except PingRate, PingRetries, AdaptiveTimeout, Retries, ScanLimit and
+// Linger where zero is meaningful.
+type Options struct {
+	IPsPerSubnet int
+	CIDRs        []string
+	// IPv4Subnets are the /24 subnets, as prefixes such as 162.159.192.,
+	// sampled when CIDRs is empty.
+	IPv4Subnets []string
+	// IPv6Prefixes are the IPv6 CIDR blocks sampled alongside IPv4Subnets
+	// when CIDRs is empty.
+	IPv6Prefixes []string
+	// Rand drives the random IP sampling. Nil seeds one from the clock.
+	Rand *rand.Rand
+	// Seed, combined with each IP, fixes that IP's Shuffle order, so the
+	// order does not depend on which IPs answer ping first. Zero seeds
+	// from the clock.
+	Seed int64
+
+	PingCount   int
+	PingTimeout time.Duration
+	PingStyle   string
+	// PingPath is the ping command run when raw ICMP sockets are not
+	// permitted, as a name looked up on PATH or a file path.
+	PingPath string
+	// PingRate caps how many pings are started per second (0 = unlimited).
+	PingRate float64
+	// PingRetries re-pings an IP that failed up to this many times, each
+	// after a random delay so retries from a burst spread out.
+	PingRetries int
+	// MaxPing drops IPs whose average RTT exceeds it before port scanning
+	// (0 = no limit).
+	MaxPing time.Duration
+	// NoPing skips pinging and port-scans every target, for networks that
+	// drop ICMP. Results then carry a zero PingResult apart from the IP.
+	NoPing bool
+
+	TCPPorts []int
+	UDPPorts []int
+	// Shuffle probes each IP's ports in a random order instead of the
+	// order of TCPPorts and UDPPorts.
+	Shuffle bool
+	// TargetPorts overrides TCPPorts and UDPPorts for individual IPs.
+	TargetPorts map[string][]int
+	// TargetHosts maps IPs to the hostname they were resolved from.
+	TargetHosts map[string]string
+	TCPTimeout  time.Duration
+	UDPTimeout  time.Duration
+	// AdaptiveTimeout sets each dial timeout to this multiple of the IP's
+	// ping RTT, at least MinAdaptiveTimeout. IPs without ping data, and a
+	// zero multiplier, use TCPTimeout and UDPTimeout.
+	AdaptiveTimeout float64
+	// DeadlineSlack, when set, gives every probe TCPTimeout or UDPTimeout
+	// plus this slack, ignoring AdaptiveTimeout, and counts only endpoints
+	// that answered within the timeout itself. Which endpoints make the
+	// cut then depends on their measured latency rather than on ping RTTs
+	// or when a timer fires, so repeated scans of the same targets find
+	// more nearly the same set. The network itself still varies.
+	DeadlineSlack time.Duration
+	// TCPMode is "connect" for a full handshake or "syn" to time the
+	// SYN-ACK to a raw SYN, falling back to connect without raw sockets.
+	// TLS and HTTP probes always connect.
+	TCPMode string
+	// UDPMode is "wireguard" to require a handshake response, "echo" to
+	// require random bytes to be echoed back, "icmp" to count ports as open
+	// unless an ICMP port unreachable comes back (silent ones as
+	// StateOpenFiltered), or "dial" for a plain connect that always
+	// succeeds.
+	UDPMode string
+	// UDPPayloadSize, when set, makes echo and icmp UDP probes send
+	// datagrams of this many bytes, filled by repeating UDPPayloadFill or,
+	// without one, with random bytes (echo) or zeros (icmp). Sizes above
+	// MaxUDPPayload need AllowFragmentation.
+	UDPPayloadSize     int
+	UDPPayloadFill     []byte
+	AllowFragmentation bool
+	// TTFBWait, when set, makes plain TCP connect probes wait this long for
+	// the first byte from the server and report the time to it as Latency,
+	// or the connect time if nothing arrives.
+	TTFBWait time.Duration
+	// AppRTTWait, when set, makes plain TCP connect probes write one byte
+	// after connecting (and after TTFBWait) and wait this long for an
+	// answer, reported as AppRTT. Silent servers leave AppRTT zero.
+	AppRTTWait time.Duration
+	// TCPInfo makes plain TCP connect probes read the kernel's TCP_INFO
+	// for the connection, filling KernelRTT and MSS. Linux only.
+	TCPInfo bool
+	// CloseWait, when set, makes plain TCP connect probes shut down their
+	// write side before closing and wait this long for the peer to answer
+	// with a FIN or RST, filling CloseLatency and PeerClose.
+	CloseWait time.Duration
+	// Protocol limits probing to "tcp" or "udp". Empty probes both.
+	Protocol           string
+	WireGuardPublicKey []byte
+	// TLSPorts are TCP ports probed with a full TLS handshake.
+	TLSPorts      []int
+	TLSServerName string
+	// HTTPPath, when set, turns TCP probes on HTTPPorts (all TCP ports if
+	// empty) into a GET that must answer 2xx or 3xx. TLS ports use https.
+	HTTPPath  string
+	HTTPPorts []int
+	// ProbeCommand, when set, is run for every endpoint that opens, with
+	// {ip}, {port} and {proto} in its arguments replaced. It must print a
+	// latency in ms and exit 0; that latency replaces the connect latency.
+	// It gets TCPTimeout or UDPTimeout to do so, however short the dial
+	// timeout AdaptiveTimeout picked.
+	ProbeCommand []string
+	// ProbeSend, when set, is written to ProbePorts (all ports if empty)
+	// after connecting, replacing the TCP and UDP probes there. A reply
+	// starting with ProbeExpect marks the result's Signature as a match.
+	ProbeSend   []byte
+	ProbeExpect []byte
+	ProbePorts  []int
+	// ScanLimit caps how many responsive IPs are port-scanned (0 = all).
+	ScanLimit int
+	// MaxProbes caps the pings and port probes sent in total, retries
+	// included (0 = no limit). Pings may use up to half of it, so the rest
+	// is left for port scanning.
+	MaxProbes   int
+	Retries     int
+	Concurrency int
+	// Samples re-probes each open endpoint until it has this many
+	// latencies and reports their median. 0 or 1 keeps the single probe.
+	Samples int
+	// MinSuccess requires this many successful probes, out of MinSuccess
+	// plus Retries attempts, before an endpoint counts as open; Latency is
+	// then their average. 0 or 1 keeps the first success. It cannot be
+	// combined with Samples.
+	MinSuccess int
+	// Warmup sends one extra, unmeasured probe to each IP before its
+	// measured ones, so ARP and route setup do not inflate the first
+	// latency. It costs one probe per IP, counted against MaxProbes.
+	Warmup bool
+	// Proxy routes TCP probes through a SOCKS5 proxy such as
+	// socks5://127.0.0.1:1080. Neither ICMP nor UDP can go through it, so
+	// when set every target is scanned without pinging and UDP is skipped.
+	Proxy *url.URL
+
+	// Pinger and Dialer replace the real ICMP pinger and network dialer,
+	// e.g. with fakes in tests. Proxy, when set, takes precedence over Dialer.
+	Pinger Pinger
+	Dialer Dialer
+	// Interface binds the default dialer, and a SOCKS5 proxy's connection,
+	// to the addresses of this network interface, e.g. wlan0.
+	Interface string
+	// LocalPorts are the source ports probes dial from, taken round-robin.
+	// A port is reused once its probe closes, and probes wait while every
+	// port is busy. Closed TCP ports stay in TIME_WAIT, and are skipped,
+	// unless Linger is 0. Ignored with a custom Dialer.
+	LocalPorts []int
+	// KeepAlive sets the TCP keep-alive period of probe connections. Zero
+	// keeps Go's default and a negative value disables keep-alives.
+	KeepAlive time.Duration
+	// Nagle turns Nagle's algorithm back on; Go sets TCP_NODELAY by default.
+	Nagle bool
+	// Linger sets SO_LINGER in seconds, 0 resetting connections on close.
+	// Negative keeps the OS default. KeepAlive, Nagle and Linger are not
+	// applied through Proxy.
+	Linger int
+
+	Weights Weights
+	// Less, when set, replaces the Weights ranking in Scanner.SortResults:
+	// it reports whether a should rank above b. Each result carries its
+	// Latency, Protocol and Endpoint, and the ping of its IP in Ping (RTT,
+	// Jitter and Loss, zero when the IP was not pinged).
+	Less func(a, b EndpointResult) bool
+
+	// OnResult, when set, is called with every open endpoint as soon as it
+	// is found. Calls come from a single goroutine, one at a time, so it
+	// needs no locking; a slow OnResult holds back the scan.
+	OnResult func(EndpointResult)
+	// OnFailure, when set, is called with the endpoint and protocol of
+	// every port probe that Failures counts. Calls come from many
+	// goroutines at once.
+	OnFailure func(endpoint, protocol string, err error)
+
+	// Logger receives debug records for every failed ping and probe, and
+	// a warning when probes run out of file descriptors. Nil discards them.
+	Logger *slog.Logger
+}
+
+func DefaultOptions() Options {
+	return Options{
+		IPsPerSubnet:       5,
+		IPv4Subnets:        DefaultIPv4Subnets,
+		IPv6Prefixes:       DefaultIPv6Prefixes,
+		PingCount:          3,
+		PingTimeout:        2 * time.Second,
+		PingStyle:          DefaultPingStyle(),
+		PingPath:           "ping",
+		PingRate:           20,
+		PingRetries:        1,
+		TCPPorts:           DefaultTCPPorts,
+		UDPPorts:           DefaultUDPPorts,
+		TCPTimeout:         5 * time.Second,
+		UDPTimeout:         5 * time.Second,
+		AdaptiveTimeout:    4,
+		TCPMode:            "connect",
+		UDPMode:            "wireguard",
+		WireGuardPublicKey: warpPublicKeyBytes(),
+		Concurrency:        200,
+		Linger:             -1,
+		Weights:            DefaultWeights,
+	}
+}
+
+func (o Options) withDefaults() Options {
+	defaults := DefaultOptions()
+	if o.IPsPerSubnet < 1 {
+		o.IPsPerSubnet = defaults.IPsPerSubnet
+	}
+	if o.IPv4Subnets == nil {
+		o.IPv4Subnets = defaults.IPv4Subnets
+	}
+	if o.IPv6Prefixes == nil {
+		o.IPv6Prefixes = defaults.IPv6Prefixes
+	}
+	if o.PingCount < 1 {
+		o.PingCount = defaults.PingCount
+	}
+	if o.PingTimeout <= 0 {
+		o.PingTimeout = defaults.PingTimeout
+	}
+	if o.PingStyle == "" {
+		o.PingStyle = defaults.PingStyle
+	}
+	if o.PingPath == "" {
+		o.PingPath = defaults.PingPath
+	}
+	if o.TCPPorts == nil {
+		o.TCPPorts = defaults.TCPPorts
+	}
+	if o.UDPPorts == nil {
+		o.UDPPorts = defaults.UDPPorts
+	}
+	if o.TCPTimeout <= 0 {
+		o.TCPTimeout = defaults.TCPTimeout
+	}
+	if o.UDPTimeout <= 0 {
+		o.UDPTimeout = defaults.UDPTimeout
+	}
+	if o.TCPMode == "" {
+		o.TCPMode = defaults.TCPMode
+	}
+	if o.UDPMode == "" {
+		o.UDPMode = defaults.UDPMode
+	}
+	if o.WireGuardPublicKey == nil {
+		o.WireGuardPublicKey = defaults.WireGuardPublicKey
+	}
+	if o.Concurrency < 1 {
+		o.Concurrency = defaults.Concurrency
+	}
+	if o.Weights == (Weights{}) {
+		o.Weights = defaults.Weights
+	}
+	if o.Rand == nil {
+		o.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	if o.Seed == 0 {
+		o.Seed = time.Now().UnixNano()
+	}
+	if o.Logger == nil {
+		o.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	return o
+}
+
+// Progress is a snapshot of how many pings and port probes have finished.
+type Progress struct {
+	PingsDone   int64
+	PingsTotal  int64
+	ProbesDone  int64
+	ProbesTotal int64
+}
+
+type Scanner struct {
+	opts          Options
+	pinger        Pinger
+	dialer        Dialer
+	tlsPorts      map[int]bool
+	httpPorts     map[int]bool
+	payloadPorts  map[int]bool
+	sem           chan struct{}
+	warmups       sync.Map // IP -> *sync.Once
+	fdWarning     sync.Once
+	noRawTCP      atomic.Bool
+	responsiveIPs atomic.Int64
+	slowIPs       atomic.Int64
+
+	pingsMu sync.Mutex
+	pings   []PingResult
+
+	failuresMu sync.Mutex
+	failures   map[string]int
+
+	budgetMu    sync.Mutex
+	issued      int
+	pingsIssued int
+	budgetSpent bool
+
+	pingsDone   atomic.Int64
+	pingsTotal  atomic.Int64
+	probesDone  atomic.Int64
+	probesTotal atomic.Int64
+}
+
+func New(opts Options) (*Scanner, error) {
+	opts = opts.withDefaults()
+	command, ok := pingStyles[opts.PingStyle]
+	if !ok {
+		return nil, fmt.Errorf("unknown ping style %q: must be unix, busybox or windows", opts.PingStyle)
+	}
+	if opts.Protocol != "" && opts.Protocol != "tcp" && opts.Protocol != "udp" {
+		return nil, fmt.Errorf("unknown protocol %q: must be tcp or udp", opts.Protocol)
+	}
+	if opts.Proxy != nil && opts.Protocol == "udp" {
+		return nil, errors.New("UDP cannot be probed through a SOCKS5 proxy")
+	}
+	if opts.TCPMode != "connect" && opts.TCPMode != "syn" {
+		return nil, fmt.Errorf("unknown TCP mode %q: must be connect or syn", opts.TCPMode)
+	}
+	if opts.Proxy != nil && opts.TCPMode == "syn" {
+		return nil, errors.New("SYN probes cannot be sent through a SOCKS5 proxy")
+	}
+	if !slices.Contains(udpModes, opts.UDPMode) {
+		return nil, fmt.Errorf("unknown UDP mode %q: must be wireguard, echo, icmp or dial", opts.UDPMode)
+	}
+	if len(opts.WireGuardPublicKey) != 32 {
+		return nil, errors.New("WireGuard public key must be 32 bytes")
+	}
+	if opts.MinSuccess > 1 && opts.Samples > 1 {
+		return nil, errors.New("MinSuccess and Samples cannot be combined")
+	}
+	if len(opts.ProbeExpect) > 0 && len(opts.ProbeSend) == 0 {
+		return nil, errors.New("ProbeExpect requires a ProbeSend payload")
+	}
+	if opts.TCPInfo && !tcpInfoSupported {
+		return nil, errors.New("TCPInfo needs TCP_INFO, which is only available on Linux")
+	}
+	if opts.UDPPayloadSize < 0 || opts.UDPPayloadSize > MaxUDPDatagram {
+		return nil, fmt.Errorf("UDP payload size %d out of range (0-%d)", opts.UDPPayloadSize, MaxUDPDatagram)
+	}
+	if opts.UDPPayloadSize > MaxUDPPayload && !opts.AllowFragmentation {
+		return nil, fmt.Errorf("UDP payload size %d exceeds %d bytes and would be fragmented", opts.UDPPayloadSize, MaxUDPPayload)
+	}
+
+	if opts.Pinger == nil && opts.Proxy == nil && !opts.NoPing && !canPing(opts.PingPath) {
+		noPingWarning.Do(func() {
+			opts.Logger.Warn("no ping command found and raw ICMP sockets are not permitted, scanning every target without pinging", "ping", opts.PingPath)
+		})
+		opts.NoPing = true
+	}
+	var pinger Pinger = systemPinger{path: opts.PingPath, command: command, count: opts.PingCount, timeout: opts.PingTimeout, logger: opts.Logger}
+	if opts.Pinger != nil {
+		pinger = opts.Pinger
+	}
+	var dialer Dialer = &net.Dialer{}
+	var bound *boundDialer
+	if opts.Interface != "" {
+		var err error
+		bound, err = bindInterface(opts.Interface)
+		if err != nil {
+			return nil, err
+		}
+		dialer = bound
+	}
+	if len(opts.LocalPorts) > 0 {
+		dialer = newPortDialer(bound, opts.LocalPorts, opts.Logger)
+	}
+	if opts.Dialer != nil {
+		dialer = opts.Dialer
+	}
+	if opts.Proxy != nil {
+		if opts.Proxy.Scheme != "socks5" && opts.Proxy.Scheme != "socks5h" {
+			return nil, fmt.Errorf("unsupported proxy scheme %q: must be socks5", opts.Proxy.Scheme)
+		}
+		var forward proxy.Dialer = proxy.Direct
+		switch d := dialer.(type) {
+		case *boundDialer:
+			forward = d
+		case *portDialer:
+			forward = d
+		}
+		proxyDialer, err := proxy.FromURL(opts.Proxy, forward)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %w", err)
+		}
+		dialer = proxyDialer.(proxy.ContextDialer)
+	} else if opts.tunesSockets() {
+		dialer = tunedDialer{dialer: dialer, opts: opts}
+	}
+
+	s := &Scanner{
+		opts:   opts,
+		pinger: pinger,
+		dialer: dialer,
+		sem:    make(chan struct{}, opts.Concurrency),
+	}
+	if len(opts.HTTPPorts) > 0 {
+		s.httpPorts = make(map[int]bool, len(opts.HTTPPorts))
+		for _, port := range opts.HTTPPorts {
+			s.httpPorts[port] = true
+		}
+	}
+	if len(opts.ProbePorts) > 0 {
+		s.payloadPorts = make(map[int]bool, len(opts.ProbePorts))
+		for _, port := range opts.ProbePorts {
+			s.payloadPorts[port] = true
+		}
+	}
+	if len(opts.TLSPorts) > 0 {
+		s.tlsPorts = make(map[int]bool, len(opts.TLSPorts))
+		for _, port := range opts.TLSPorts {
+			s.tlsPorts[port] = true
+		}
+	}
+	return s, nil
+}
+
+func (s *Scanner) Progress() Progress {
+	return Progress{
+		PingsDone:   s.pingsDone.Load(),
+		PingsTotal:  s.pingsTotal.Load(),
+		ProbesDone:  s.probesDone.Load(),
+		ProbesTotal: s.probesTotal.Load(),
+	}
+}
+
+// ResponsiveIPs reports how many IPs answered ping and were queued for
+// port scanning.
+func (s *Scanner) ResponsiveIPs() int {
+	return int(s.responsiveIPs.Load())
+}
+
+// Pings returns every successful ping so far, including IPs dropped by
+// MaxPing, in completion order.
+func (s *Scanner) Pings() []PingResult {
+	s.pingsMu.Lock()
+	defer s.pingsMu.Unlock()
+	return slices.Clone(s.pings)
+}
+
+// SlowIPs reports how many IPs answered ping but were dropped by MaxPing.
+func (s *Scanner) SlowIPs() int {
+	return int(s.slowIPs.Load())
+}
+
+// SkipsPing reports whether targets are port-scanned without pinging,
+// because of Options.Proxy or Options.NoPing or because no way to ping is
+// available.
+func (s *Scanner) SkipsPing() bool {
+	return s.opts.Proxy != nil || s.opts.NoPing
+}
+
+// PingAll pings every IP and returns the ones that answered, fastest first.
+func (s *Scanner) PingAll(ctx context.Context, ips []string) []PingResult {
+	var results []PingResult
+	for result := range s.pingStage(ctx, ips) {
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].RTT < results[j].RTT
+	})
+	return results
+}
+
+// ScanPorts probes tcpPorts and udpPorts on every target and returns the
+// endpoints that opened.
+func (s *Scanner) ScanPorts(ctx context.Context, targets []PingResult, tcpPorts, udpPorts []int) []EndpointResult {
+	targetsChan := make(chan PingResult, stageBuffer)
+	go func() {
+		for _, target := range targets {
+			targetsChan <- target
+		}
+		close(targetsChan)
+	}()
+
+	var results []EndpointResult
+	for result := range s.scanStage(ctx, targetsChan, tcpPorts, udpPorts) {
+		results = append(results, result)
+	}
+	return results
+}
+
+// Pipeline pings ips and port-scans each responsive IP as soon as its ping
+// completes, streaming open endpoints on the returned channel. The channel
+// is closed once every probe has finished or ctx is cancelled.
+func (s *Scanner) Pipeline(ctx context.Context, ips []string) <-chan EndpointResult {
+	return s.scanStage(ctx, s.pingStage(ctx, ips), s.opts.TCPPorts, s.opts.UDPPorts)
+}
+
+// stageBuffer sizes the channels between stages. They are drained while
+// being filled, so the buffer only smooths bursts and stays small however
+// many targets are scanned.
+const stageBuffer = 64
+
+func acquire(ctx context.Context, sem chan<- struct{}) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	select {
+	case sem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *Scanner) pingStage(ctx context.Context, ips []string) <-chan PingResult {
+	pingResultsChan := make(chan PingResult, stageBuffer)
+	s.pingsTotal.Add(int64(len(ips)))
+
+	if s.SkipsPing() {
+		go func() {
+			for _, ip := range ips {
+				pingResultsChan <- PingResult{IP: ip}
+				s.pingsDone.Add(1)
+			}
+			close(pingResultsChan)
+		}()
+		return pingResultsChan
+	}
+
+	go func() {
+		var tick <-chan time.Time
+		if s.opts.PingRate > 0 {
+			ticker := time.NewTicker(time.Duration(float64(time.Second) / s.opts.PingRate))
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		var pingWg sync.WaitGroup
+	dispatch:
+		for i, ip := range ips {
+			if tick != nil && i > 0 {
+				select {
+				case <-tick:
+				case <-ctx.Done():
+					break dispatch
+				}
+			}
+			if s.outOfBudget(true) || !acquire(ctx, s.sem) {
+				break
+			}
+			pingWg.Add(1)
+			go func(ipAddr string) {
+				defer pingWg.Done()
+				defer s.pingsDone.Add(1)
+				result, err := s.pingWithRetries(ctx, ipAddr)
+				if err != nil {
+					return
+				}
+				s.pingsMu.Lock()
+				s.pings = append(s.pings, result)
+				s.pingsMu.Unlock()
+				if s.opts.MaxPing > 0 && result.RTT > s.opts.MaxPing {
+					s.opts.Logger.Debug("ping too slow", "ip", ipAddr, "rtt", result.RTT)
+					s.slowIPs.Add(1)
+					return
+				}
+				pingResultsChan <- result
+			}(ip)
+		}
+		pingWg.Wait()
+		close(pingResultsChan)
+	}()
+
+	return pingResultsChan
+}
+
+type scanJob struct {
+	target   PingResult
+	port     int
+	protocol string
+}
+
+func (s *Scanner) jobsFor(ctx context.Context, target PingResult, tcpPorts, udpPorts []int) []scanJob {
+	if ctx.Err() != nil || (s.opts.ScanLimit > 0 && s.ResponsiveIPs() >= s.opts.ScanLimit) {
+		return nil
+	}
+	s.responsiveIPs.Add(1)
+
+	var jobs []scanJob
+	for _, probe := range s.probesFor(target.IP, tcpPorts, udpPorts) {
+		jobs = append(jobs, scanJob{target: target, port: probe.Port, protocol: probe.Protocol})
+	}
+	if s.opts.Shuffle {
+		h := fnv.New64a()
+		h.Write([]byte(target.IP))
+		rng := rand.New(rand.NewSource(s.opts.Seed ^ int64(h.Sum64())))
+		rng.Shuffle(len(jobs), func(i, j int) { jobs[i], jobs[j] = jobs[j], jobs[i] })
+	}
+	s.probesTotal.Add(int64(len(jobs)))
+	return jobs
+}
+
+// Probe is a single port probe the scanner would send to a responsive IP.
+type Probe struct {
+	IP       string
+	Port     int
+	Protocol string
+}
+
+// Plan lists every probe Pipeline would send if all of ips answered ping,
+// without sending any traffic.
+func (s *Scanner) Plan(ips []string) []Probe {
+	var probes []Probe
+	for _, ip := range ips {
+		probes = append(probes, s.probesFor(ip, s.opts.TCPPorts, s.opts.UDPPorts)...)
+	}
+	return probes
+}
+
+func (s *Scanner) probesFor(ip string, tcpPorts, udpPorts []int) []Probe {
+	if ports := s.opts.TargetPorts[ip]; len(ports) > 0 {
+		tcpPorts, udpPorts = ports, ports
+	}
+	if s.opts.Proxy != nil || s.opts.Protocol == "tcp" {
+		udpPorts = nil
+	}
+	if s.opts.Protocol == "udp" {
+		tcpPorts = nil
+	}
+	var probes []Probe
+	for _, port := range tcpPorts {
+		probes = append(probes, Probe{IP: ip, Port: port, Protocol: "tcp"})
+	}
+	for _, port := range udpPorts {
+		probes = append(probes, Probe{IP: ip, Port: port, Protocol: "udp"})
+	}
+	return probes
+}
+
+// pingRetryDelay is the mean wait before a ping retry; the actual wait is
+// uniformly spread over half to one and a half times it.
+const pingRetryDelay = time.Second
+
+// pingWithRetries pings ip up to 1+Options.PingRetries times, stopping
+// early once Options.MaxProbes is spent. It is called holding a slot of
+// s.sem, which it gives up while waiting to retry and releases before
+// returning.
+func (s *Scanner) pingWithRetries(ctx context.Context, ip string) (PingResult, error) {
+	held := true
+	defer func() {
+		if held {
+			<-s.sem
+		}
+	}()
+	for attempt := 1; ; attempt++ {
+		if !s.spend(true) {
+			return PingResult{}, errBudgetSpent
+		}
+		result, err := s.pinger.Ping(ctx, ip)
+		if err == nil {
+			if attempt > 1 {
+				s.opts.Logger.Debug("ping succeeded on retry", "ip", ip, "attempts", attempt)
+			}
+			return result, nil
+		}
+		s.opts.Logger.Debug("ping failed", "ip", ip, "attempt", attempt, "err", err)
+		if attempt > s.opts.PingRetries || ctx.Err() != nil || s.outOfBudget(true) {
+			return PingResult{}, err
+		}
+
+		<-s.sem
+		held = false
+		delay := pingRetryDelay/2 + time.Duration(rand.Int63n(int64(pingRetryDelay)))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return PingResult{}, ctx.Err()
+		}
+		if !acquire(ctx, s.sem) {
+			return PingResult{}, ctx.Err()
+		}
+		held = true
+	}
+}
+
+// scanStage dispatches port probes round-robin across the targets received
+// so far, so every IP gets probes early instead of one IP being fully
+// scanned before the next starts.
+func (s *Scanner) scanStage(ctx context.Context, targets <-chan PingResult, tcpPorts, udpPorts []int) <-chan EndpointResult {
+	endpointResultsChan := make(chan EndpointResult, stageBuffer)
+
+	go func() {
+		var portWg sync.WaitGroup
+		var queues [][]scanJob
+		next := 0
+		pending := targets
+		for pending != nil || len(queues) > 0 {
+			if ctx.Err() != nil || s.outOfBudget(false) {
+				queues = nil
+			}
+			if len(queues) == 0 {
+				target, ok := <-pending
+				if !ok {
+					pending = nil
+					continue
+				}
+				if jobs := s.jobsFor(ctx, target, tcpPorts, udpPorts); len(jobs) > 0 {
+					queues = append(queues, jobs)
+				}
+				continue
+			}
+
+			select {
+			case target, ok := <-pending:
+				if !ok {
+					pending = nil
+					continue
+				}
+				if jobs := s.jobsFor(ctx, target, tcpPorts, udpPorts); len(jobs) > 0 {
+					queues = append(queues, jobs)
+				}
+			case s.sem <- struct{}{}:
+				job := queues[next][0]
+				queues[next] = queues[next][1:]
+				if len(queues[next]) == 0 {
+					queues = append(queues[:next], queues[next+1:]...)
+				} else {
+					next++
+				}
+				if next >= len(queues) {
+					next = 0
+				}
+				portWg.Add(1)
+				go s.scanPort(ctx, job.target, job.port, job.protocol, endpointResultsChan, &portWg)
+			case <-ctx.Done():
+			}
+		}
+		portWg.Wait()
+		close(endpointResultsChan)
+	}()
+
+	return s.notify(endpointResultsChan)
+}
+
+// notify passes results through Options.OnResult, if set, on a single
+// goroutine before they reach the caller.
+func (s *Scanner) notify(results <-chan EndpointResult) <-chan EndpointResult {
+	if s.opts.OnResult == nil {
+		return results
+	}
+	notified := make(chan EndpointResult, stageBuffer)
+	go func() {
+		for result := range results {
+			s.opts.OnResult(result)
+			notified <- result
+		}
+		close(notified)
+	}()
+	return notified
+}
+
+const (
+	retryBackoff    = 100 * time.Millisecond
+	maxRetryBackoff = 5 * time.Second
+)
+
+// backoff is the wait before the nth retry of a port probe: retryBackoff,
+// doubling with each retry up to maxRetryBackoff.
+func backoff(retry int) time.Duration {
+	return min(retryBackoff<<min(retry-1, 6), maxRetryBackoff)
+}
+
+var errNoHandshake = errors.New("no WireGuard handshake response")
+
+var errNoEcho = errors.New("no UDP echo")
+
+var errPastDeadline = errors.New("answered after the probe timeout")
+
+var udpModes = []string{"wireguard", "echo", "icmp", "dial"}
+
+// dialNetwork pins protocol to the address family of ip, e.g. tcp6 for an
+// IPv6 literal, since some stacks reject v6 addresses on a bare "tcp" dial.
+func dialNetwork(protocol, ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		return protocol + "6"
+	}
+	return protocol + "4"
+}
+
+// Dialer opens probe connections. *net.Dialer and SOCKS5 proxy dialers
+// from golang.org/x/net/proxy satisfy it.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// MinAdaptiveTimeout is the floor for timeouts derived from ping RTT.
+const MinAdaptiveTimeout = 500 * time.Millisecond
+
+func (s *Scanner) dialTimeout(target PingResult, protocol string) time.Duration {
+	if s.opts.DeadlineSlack > 0 {
+		return s.fixedTimeout(protocol) + s.opts.DeadlineSlack
+	}
+	if s.opts.AdaptiveTimeout > 0 && target.RTT > 0 {
+		return max(time.Duration(s.opts.AdaptiveTimeout*float64(target.RTT)), MinAdaptiveTimeout)
+	}
+	return s.fixedTimeout(protocol)
+}
+
+func (s *Scanner) fixedTimeout(protocol string) time.Duration {
+	if protocol == "udp" {
+		return s.opts.UDPTimeout
+	}
+	return s.opts.TCPTimeout
+}
+
+func (s *Scanner) probeTLS(ctx context.Context, network, address string, timeout time.Duration, result EndpointResult) (EndpointResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	rawConn, err := s.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return result, err
+	}
+	conn := tls.Client(rawConn, &tls.Config{
+		ServerName:         s.opts.TLSServerName,
+		InsecureSkipVerify: true,
+	})
+	defer conn.Close()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return result, err
+	}
+	result.Latency = time.Since(start)
+	result.LocalAddr = conn.LocalAddr().String()
+	s.recordRemote(&result, rawConn)
+	state := conn.ConnectionState()
+	result.TLSVersion = tls.VersionName(state.Version)
+	result.TLSCipher = tls.CipherSuiteName(state.CipherSuite)
+	return result, nil
+}
+
+func (s *Scanner) probe(ctx context.Context, target PingResult, port int, protocol string) (EndpointResult, error) {
+	if !s.spend(false) {
+		return EndpointResult{}, errBudgetSpent
+	}
+	result, err := s.connect(ctx, target, port, protocol)
+	if err == nil && s.opts.DeadlineSlack > 0 && result.Latency > s.fixedTimeout(protocol) {
+		return result, errPastDeadline
+	}
+	if err != nil || len(s.opts.ProbeCommand) == 0 {
+		return result, err
+	}
+	return s.runProbeCommand(ctx, result, s.fixedTimeout(protocol))
+}
+
+func (s *Scanner) connect(ctx context.Context, target PingResult, port int, protocol string) (EndpointResult, error) {
+	address := net.JoinHostPort(target.IP, strconv.Itoa(port))
+	result := EndpointResult{Endpoint: address, Target: address, Protocol: protocol, Ping: target, Hostname: s.opts.TargetHosts[target.IP]}
+	timeout := s.dialTimeout(target, protocol)
+
+	if len(s.opts.ProbeSend) > 0 && (s.payloadPorts == nil || s.payloadPorts[port]) {
+		return s.probePayload(ctx, dialNetwork(protocol, target.IP), address, timeout, result)
+	}
+
+	if protocol == "udp" && s.opts.UDPMode == "wireguard" {
+		latency, localAddr, ok := probeUDPWireGuard(ctx, s.dialer, target.IP, port, timeout, s.opts.WireGuardPublicKey)
+		if !ok {
+			return result, errNoHandshake
+		}
+		result.Latency = latency
+		result.LocalAddr = localAddr.String()
+		return result, nil
+	}
+
+	if protocol == "udp" && s.opts.UDPMode == "echo" {
+		latency, localAddr, ok := probeUDPEcho(ctx, s.dialer, target.IP, port, timeout, s.udpPayload(udpEchoPayloadSize, true))
+		if !ok {
+			return result, errNoEcho
+		}
+		result.Latency = latency
+		result.LocalAddr = localAddr.String()
+		return result, nil
+	}
+
+	if protocol == "udp" && s.opts.UDPMode == "icmp" {
+		latency, localAddr, answered, err := probeUDPICMP(ctx, s.dialer, target.IP, port, timeout, s.udpPayload(1, false))
+		if err != nil {
+			return result, err
+		}
+		result.Latency = latency
+		result.LocalAddr = localAddr.String()
+		if !answered {
+			result.State = StateOpenFiltered
+		}
+		return result, nil
+	}
+
+	if protocol == "tcp" && s.opts.HTTPPath != "" && (s.httpPorts == nil || s.httpPorts[port]) {
+		return s.probeHTTP(ctx, dialNetwork(protocol, target.IP), address, port, timeout, result)
+	}
+
+	if protocol == "tcp" && s.tlsPorts[port] {
+		return s.probeTLS(ctx, dialNetwork(protocol, target.IP), address, timeout, result)
+	}
+
+	if protocol == "tcp" && s.opts.TCPMode == "syn" && !s.noRawTCP.Load() {
+		latency, localAddr, err := probeTCPSYN(ctx, s.dialer, target.IP, port, timeout)
+		if !errors.Is(err, errSYNUnavailable) {
+			if err != nil {
+				return result, err
+			}
+			result.Latency = latency
+			result.LocalAddr = localAddr.String()
+			return result, nil
+		}
+		if s.noRawTCP.CompareAndSwap(false, true) {
+			s.opts.Logger.Warn("SYN probes need raw sockets, falling back to full connect", "err", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	conn, err := s.dialer.DialContext(ctx, dialNetwork(protocol, target.IP), address)
+	result.Latency = time.Since(start)
+	if err != nil {
+		return result, err
+	}
+	result.LocalAddr = conn.LocalAddr().String()
+	s.recordRemote(&result, conn)
+	defer conn.Close()
+	if protocol == "tcp" && s.opts.TTFBWait > 0 {
+		result.ConnectLatency = result.Latency
+		conn.SetReadDeadline(time.Now().Add(s.opts.TTFBWait))
+		if n, _ := conn.Read(make([]byte, 1)); n == 1 {
+			result.TTFB = time.Since(start)
+			result.Latency = result.TTFB
+		}
+	}
+	if protocol == "tcp" && s.opts.AppRTTWait > 0 {
+		result.AppRTT = appRTT(conn, s.opts.AppRTTWait)
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	if pc, isPortConn := conn.(*portConn); isPortConn {
+		tcp, ok = pc.Conn.(*net.TCPConn)
+	}
+	if ok && s.opts.TCPInfo {
+		if result.KernelRTT, result.MSS, err = readTCPInfo(tcp); err != nil {
+			s.opts.Logger.Debug("could not read TCP_INFO", "endpoint", address, "err", err)
+		}
+	}
+	if ok && s.opts.CloseWait > 0 {
+		result.CloseLatency, result.PeerClose = measureClose(tcp, s.opts.CloseWait)
+		s.opts.Logger.Debug("connection teardown", "endpoint", address, "peer_close", result.PeerClose, "close_latency", result.CloseLatency)
+	}
+	return result, nil
+}
+
+// recordRemote sets result.Endpoint to the address conn reached. Proxied
+// connections only know the proxy's address, so they keep the target.
+func (s *Scanner) recordRemote(result *EndpointResult, conn net.Conn) {
+	if s.opts.Proxy != nil {
+		return
+	}
+	if addr := conn.RemoteAddr(); addr != nil {
+		result.Endpoint = addr.String()
+	}
+}
+
+// measureClose sends a FIN on conn and times the peer's FIN or RST,
+// returning "" if neither arrives within wait.
+func measureClose(conn *net.TCPConn, wait time.Duration) (time.Duration, string) {
+	start := time.Now()
+	if err := conn.CloseWrite(); err != nil {
+		return 0, ""
+	}
+	conn.SetReadDeadline(start.Add(wait))
+	buf := make([]byte, 512)
+	for {
+		_, err := conn.Read(buf)
+		switch {
+		case err == nil:
+			continue
+		case errors.Is(err, io.EOF):
+			return time.Since(start), "fin"
+		case errors.Is(err, syscall.ECONNRESET):
+			return time.Since(start), "rst"
+		}
+		return 0, ""
+	}
+}
+
+// appRTT writes a newline to conn and times the first byte back, or
+// returns 0 if none arrives within wait.
+func appRTT(conn net.Conn, wait time.Duration) time.Duration {
+	sent := time.Now()
+	conn.SetDeadline(sent.Add(wait))
+	if _, err := conn.Write([]byte{'\n'}); err != nil {
+		return 0
+	}
+	if n, _ := conn.Read(make([]byte, 1)); n == 1 {
+		return time.Since(sent)
+	}
+	return 0
+}
+
+func (s *Scanner) scanPort(ctx context.Context, target PingResult, port int, protocol string, resultsChan chan<- EndpointResult, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer func() { <-s.sem }()
+	defer s.probesDone.Add(1)
+
+	result, err := s.probeWithRetries(ctx, target, port, protocol)
+	if err == nil {
+		resultsChan <- result
+		return
+	}
+	if ctx.Err() == nil && !errors.Is(err, errBudgetSpent) {
+		s.recordFailure(err)
+		if s.opts.OnFailure != nil {
+			s.opts.OnFailure(net.JoinHostPort(target.IP, strconv.Itoa(port)), protocol, err)
+		}
+	}
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+		s.fdWarning.Do(func() {
+			s.opts.Logger.Warn("out of file descriptors, probes are failing; lower the concurrency or raise ulimit -n",
+				"concurrency", s.opts.Concurrency, "err", err)
+		})
+	}
+}
+
+// probeWithRetries probes until the first success, Options.Retries failed
+// retries or the end of Options.MaxProbes, then takes the extra latency
+// samples.
+func (s *Scanner) probeWithRetries(ctx context.Context, target PingResult, port int, protocol string) (EndpointResult, error) {
+	if s.opts.Warmup {
+		s.warmUp(ctx, target, port, protocol)
+	}
+	if s.opts.MinSuccess > 1 {
+		return s.probeReliably(ctx, target, port, protocol)
+	}
+	var err error
+	for attempt := 0; attempt <= s.opts.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff(attempt)):
+			case <-ctx.Done():
+				return EndpointResult{}, ctx.Err()
+			}
+		}
+		var result EndpointResult
+		result, err = s.probe(ctx, target, port, protocol)
+		if err == nil {
+			if s.opts.Samples > 1 {
+				result = s.sample(ctx, result, port)
+			}
+			return result, nil
+		}
+		if ctx.Err() != nil {
+			return EndpointResult{}, ctx.Err()
+		}
+		if errors.Is(err, errBudgetSpent) {
+			return EndpointResult{}, err
+		}
+		s.opts.Logger.Debug("probe failed", "ip", target.IP, "port", port, "proto", protocol, "attempt", attempt+1, "err", err)
+		if s.outOfBudget(false) {
+			break
+		}
+	}
+	return EndpointResult{}, err
+}
+
+// warmUp sends the first probe to target and discards it. Concurrent
+// probes to the same IP wait until it has finished. It counts against
+// Options.MaxProbes and is skipped once the budget is spent.
+func (s *Scanner) warmUp(ctx context.Context, target PingResult, port int, protocol string) {
+	once, _ := s.warmups.LoadOrStore(target.IP, new(sync.Once))
+	once.(*sync.Once).Do(func() {
+		if !s.spend(false) {
+			return
+		}
+		_, err := s.connect(ctx, target, port, protocol)
+		s.opts.Logger.Debug("warm-up probe", "ip", target.IP, "port", port, "proto", protocol, "err", err)
+	})
+}
+
+// CheckResult is the outcome of Check for a single endpoint.
+type CheckResult struct {
+	Ping    PingResult
+	PingErr error
+	// Endpoints holds the protocols that opened, Errors the ones that did
+	// not, keyed by "tcp" or "udp".
+	Endpoints []EndpointResult
+	Errors    map[string]error
+}
+
+// Check pings ip and probes port on it over each enabled protocol, without
+// target generation. The probes run even if the ping gets no reply.
+func (s *Scanner) Check(ctx context.Context, ip string, port int) CheckResult {
+	check := CheckResult{Errors: make(map[string]error)}
+	if !s.SkipsPing() {
+		check.Ping, check.PingErr = s.pinger.Ping(ctx, ip)
+	}
+	target := check.Ping
+	target.IP = ip
+	for _, probe := range s.probesFor(ip, []int{port}, []int{port}) {
+		result, err := s.probeWithRetries(ctx, target, probe.Port, probe.Protocol)
+		if err != nil {
+			check.Errors[probe.Protocol] = err
+			continue
+		}
+		check.Endpoints = append(check.Endpoints, result)
+	}
+	return check
+}
+
+// probeReliably probes until Options.MinSuccess probes have succeeded,
+// giving up once the remaining attempts cannot reach it.
+func (s *Scanner) probeReliably(ctx context.Context, target PingResult, port int, protocol string) (EndpointResult, error) {
+	attempts := s.opts.MinSuccess + s.opts.Retries
+	var first EndpointResult
+	var total time.Duration
+	var err error
+	successes, failures, timed := 0, 0, 0
+	for successes < s.opts.MinSuccess && attempts-failures >= s.opts.MinSuccess {
+		if failures > 0 {
+			select {
+			case <-time.After(backoff(failures)):
+			case <-ctx.Done():
+				return EndpointResult{}, ctx.Err()
+			}
+		}
+		result, probeErr := s.probe(ctx, target, port, protocol)
+		if ctx.Err() != nil {
+			return EndpointResult{}, ctx.Err()
+		}
+		if errors.Is(probeErr, errBudgetSpent) {
+			return EndpointResult{}, probeErr
+		}
+		if probeErr != nil {
+			err = probeErr
+			failures++
+			s.opts.Logger.Debug("probe failed", "ip", target.IP, "port", port, "proto", protocol, "attempt", successes+failures, "err", err)
+			if s.outOfBudget(false) {
+				break
+			}
+			continue
+		}
+		if successes == 0 || (first.State == StateOpenFiltered && result.State != StateOpenFiltered) {
+			first = result
+		}
+		successes++
+		if result.State != StateOpenFiltered {
+			timed++
+			total += result.Latency
+		}
+	}
+	if successes < s.opts.MinSuccess {
+		return EndpointResult{}, fmt.Errorf("only %d of %d probes succeeded: %w", successes, successes+failures, err)
+	}
+	if timed > 0 {
+		first.Latency = total / time.Duration(timed)
+	}
+	return first, nil
+}
+
+// sample re-probes an endpoint that just opened and replaces its latency
+// with the median of the successful samples, first one included.
+func (s *Scanner) sample(ctx context.Context, first EndpointResult, port int) EndpointResult {
+	if first.State == StateOpenFiltered {
+		return first
+	}
+	latencies := []time.Duration{first.Latency}
+	for i := 1; i < s.opts.Samples && ctx.Err() == nil; i++ {
+		result, err := s.probe(ctx, first.Ping, port, first.Protocol)
+		if err == nil && result.State == StateOpenFiltered {
+			err = errors.New("no answer to time")
+		}
+		if err != nil {
+			s.opts.Logger.Debug("sample failed", "endpoint", first.Endpoint, "proto", first.Protocol, "sample", i+1, "err", err)
+			continue
+		}
+		latencies = append(latencies, result.Latency)
+	}
+	slices.Sort(latencies)
+	mid := len(latencies) / 2
+	first.Latency = latencies[mid]
+	if len(latencies)%2 == 0 {
+		first.Latency = (latencies[mid-1] + latencies[mid]) / 2
+	}
+	first.MinLatency = latencies[0]
+	return first
+}
+
+func ScoreEndpoint(r EndpointResult, w Weights) float64 {
+	return w.Latency*float64(r.Latency.Nanoseconds())/1e6 +
+		w.Ping*float64(r.Ping.RTT.Nanoseconds())/1e6 +
+		w.Jitter*float64(r.Ping.Jitter.Nanoseconds())/1e6 +
+		w.Loss*r.Ping.Loss
+}
+
+// SortResults orders results best first with Options.Less, or by
+// Options.Weights when Less is nil. Either way StateOpenFiltered results,
+// which never answered, come after the endpoints that did.
+func (s *Scanner) SortResults(results []EndpointResult) {
+	if s.opts.Less == nil {
+		SortResults(results, s.opts.Weights)
+		return
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if fa, fb := a.State == StateOpenFiltered, b.State == StateOpenFiltered; fa != fb {
+			return fb
+		}
+		return s.opts.Less(a, b)
+	})
+}
+
+// SortResults orders results best first by ScoreEndpoint, after putting
+// StateOpenFiltered results last. Ties go to the lower port, then the
+// lower IP string, then the lower ping RTT, so the same results always
+// rank the same way.
+func SortResults(results []EndpointResult, w Weights) {
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if fa, fb := a.State == StateOpenFiltered, b.State == StateOpenFiltered; fa != fb {
+			return fb
+		}
+		if sa, sb := ScoreEndpoint(a, w), ScoreEndpoint(b, w); sa != sb {
+			return sa < sb
+		}
+		hostA, portA := splitEndpoint(a.Endpoint)
+		hostB, portB := splitEndpoint(b.Endpoint)
+		if portA != portB {
+			return portA < portB
+		}
+		if hostA != hostB {
+			return hostA < hostB
+		}
+		return a.Ping.RTT < b.Ping.RTT
+	})
+}
+
+func splitEndpoint(endpoint string) (string, int) {
+	host, portStr, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return endpoint, 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	return host, port
+}
@@ -0,0 +1,396 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakePinger answers with the ping listed for an IP and fails the rest.
+type fakePinger map[string]PingResult
+
+func (p fakePinger) Ping(_ context.Context, ip string) (PingResult, error) {
+	result, ok := p[ip]
+	if !ok {
+		return PingResult{}, errors.New("no response from host")
+	}
+	result.IP = ip
+	return result, nil
+}
+
+// fakeDialer connects to the "network address" pairs it lists and refuses
+// the rest.
+type fakeDialer map[string]bool
+
+func (d fakeDialer) DialContext(_ context.Context, network, address string) (net.Conn, error) {
+	if !d[network+" "+address] {
+		return nil, syscall.ECONNREFUSED
+	}
+	remote, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeConn{remote: remote}, nil
+}
+
+// fakeConn is an established connection. It answers a WireGuard handshake
+// initiation with a matching response and carries no other data.
+type fakeConn struct {
+	net.Conn
+	remote net.Addr
+	sender []byte
+}
+
+func (c *fakeConn) Write(b []byte) (int, error) {
+	if len(b) >= 8 && b[0] == 1 {
+		c.sender = slices.Clone(b[4:8])
+	}
+	return len(b), nil
+}
+
+func (c *fakeConn) Read(b []byte) (int, error) {
+	if c.sender == nil || len(b) < wgResponseSize {
+		return 0, errors.New("no data")
+	}
+	clear(b[:wgResponseSize])
+	b[0] = 2
+	copy(b[8:12], c.sender)
+	c.sender = nil
+	return wgResponseSize, nil
+}
+
+func (c *fakeConn) LocalAddr() net.Addr  { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000} }
+func (c *fakeConn) RemoteAddr() net.Addr { return c.remote }
+func (c *fakeConn) Close() error         { return nil }
+
+func (c *fakeConn) SetDeadline(time.Time) error     { return nil }
+func (c *fakeConn) SetReadDeadline(time.Time) error { return nil }
+
+func TestPipelineWithFakes(t *testing.T) {
+	ms := time.Millisecond
+	pings := fakePinger{
+		"10.0.0.1": {RTT: 30 * ms, Jitter: 30 * ms},
+		"10.0.0.2": {RTT: 10 * ms, Jitter: 10 * ms},
+		"10.0.0.3": {RTT: 20 * ms, Jitter: 20 * ms},
+	}
+	tests := []struct {
+		name    string
+		open    fakeDialer
+		wantTCP []string
+		wantUDP []string
+	}{
+		{
+			name: "grouped by protocol and ranked by jitter",
+			open: fakeDialer{
+				"tcp4 10.0.0.1:443": true, "tcp4 10.0.0.2:443": true,
+				"udp4 10.0.0.1:2408": true, "udp4 10.0.0.3:2408": true,
+			},
+			wantTCP: []string{"10.0.0.2:443", "10.0.0.1:443"},
+			wantUDP: []string{"10.0.0.3:2408", "10.0.0.1:2408"},
+		},
+		{
+			name:    "IPs that do not answer ping are not scanned",
+			open:    fakeDialer{"tcp4 10.0.0.3:443": true, "tcp4 10.0.0.4:443": true, "udp4 10.0.0.4:2408": true},
+			wantTCP: []string{"10.0.0.3:443"},
+		},
+		{
+			name:    "refused ports are left out",
+			open:    fakeDialer{"udp4 10.0.0.2:2408": true},
+			wantUDP: []string{"10.0.0.2:2408"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New(Options{
+				Pinger:   pings,
+				Dialer:   tt.open,
+				TCPPorts: []int{443},
+				UDPPorts: []int{2408},
+				Weights:  Weights{Jitter: 1},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var tcp, udp []EndpointResult
+			for result := range s.Pipeline(context.Background(), []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}) {
+				if result.Protocol == "tcp" {
+					tcp = append(tcp, result)
+				} else {
+					udp = append(udp, result)
+				}
+			}
+			SortResults(tcp, Weights{Jitter: 1})
+			SortResults(udp, Weights{Jitter: 1})
+			if got := endpoints(tcp); !slices.Equal(got, tt.wantTCP) {
+				t.Errorf("TCP endpoints = %v, want %v", got, tt.wantTCP)
+			}
+			if got := endpoints(udp); !slices.Equal(got, tt.wantUDP) {
+				t.Errorf("UDP endpoints = %v, want %v", got, tt.wantUDP)
+			}
+		})
+	}
+}
+
+func TestSortResults(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name    string
+		weights Weights
+		results []EndpointResult
+		want    []string
+	}{
+		{
+			name:    "latency",
+			weights: Weights{Latency: 1},
+			results: []EndpointResult{
+				{Endpoint: "10.0.0.1:443", Latency: 30 * ms},
+				{Endpoint: "10.0.0.2:443", Latency: 10 * ms},
+				{Endpoint: "10.0.0.3:443", Latency: 20 * ms},
+			},
+			want: []string{"10.0.0.2:443", "10.0.0.3:443", "10.0.0.1:443"},
+		},
+		{
+			name:    "loss outweighs latency",
+			weights: DefaultWeights,
+			results: []EndpointResult{
+				{Endpoint: "10.0.0.1:443", Latency: 10 * ms, Ping: PingResult{Loss: 20}},
+				{Endpoint: "10.0.0.2:443", Latency: 100 * ms},
+			},
+			want: []string{"10.0.0.2:443", "10.0.0.1:443"},
+		},
+		{
+			name:    "jitter",
+			weights: DefaultWeights,
+			results: []EndpointResult{
+				{Endpoint: "10.0.0.1:443", Latency: 10 * ms, Ping: PingResult{Jitter: 50 * ms}},
+				{Endpoint: "10.0.0.2:443", Latency: 60 * ms, Ping: PingResult{Jitter: 2 * ms}},
+			},
+			want: []string{"10.0.0.2:443", "10.0.0.1:443"},
+		},
+		{
+			name:    "open|filtered after responders",
+			weights: Weights{Latency: 1},
+			results: []EndpointResult{
+				{Endpoint: "10.0.0.1:2408", State: StateOpenFiltered},
+				{Endpoint: "10.0.0.2:2408", Latency: 40 * ms},
+				{Endpoint: "10.0.0.3:500", State: StateOpenFiltered},
+				{Endpoint: "10.0.0.4:2408", Latency: 20 * ms},
+			},
+			want: []string{"10.0.0.4:2408", "10.0.0.2:2408", "10.0.0.3:500", "10.0.0.1:2408"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SortResults(tt.results, tt.weights)
+			if got := endpoints(tt.results); !slices.Equal(got, tt.want) {
+				t.Errorf("SortResults = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func endpoints(results []EndpointResult) []string {
+	var out []string
+	for _, result := range results {
+		out = append(out, result.Endpoint)
+	}
+	return out
+}
+
+func TestScanPortsIPv6Loopback(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	s, err := New(Options{TCPTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := s.ScanPorts(context.Background(), []PingResult{{IP: "::1"}}, []int{port}, nil)
+	if len(results) != 1 {
+		t.Fatalf("got %d open endpoints, want 1", len(results))
+	}
+	want := net.JoinHostPort("::1", strconv.Itoa(port))
+	if results[0].Endpoint != want || results[0].Target != want {
+		t.Errorf("Endpoint = %q, Target = %q, want %q", results[0].Endpoint, results[0].Target, want)
+	}
+	if host, _, err := net.SplitHostPort(results[0].Endpoint); err != nil || host != "::1" {
+		t.Errorf("SplitHostPort(%q) = %q, %v, want ::1", results[0].Endpoint, host, err)
+	}
+}
+
+func TestShuffleOrderPerIP(t *testing.T) {
+	ips := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	order := func(ips []string) map[string][]int {
+		s, err := New(Options{NoPing: true, Shuffle: true, Seed: 42, TCPPorts: []int{80, 443, 2053, 8443}, UDPPorts: []int{500, 2408}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports := make(map[string][]int)
+		for _, ip := range ips {
+			for _, job := range s.jobsFor(context.Background(), PingResult{IP: ip}, s.opts.TCPPorts, s.opts.UDPPorts) {
+				ports[ip] = append(ports[ip], job.port)
+			}
+		}
+		return ports
+	}
+	first := order(ips)
+	reversed := slices.Clone(ips)
+	slices.Reverse(reversed)
+	second := order(reversed)
+	for _, ip := range ips {
+		if !slices.Equal(first[ip], second[ip]) {
+			t.Errorf("%s: port order %v, then %v with the IPs in another order", ip, first[ip], second[ip])
+		}
+	}
+}
+
+// openDialer connects to every address.
+type openDialer struct{}
+
+func (openDialer) DialContext(_ context.Context, _, address string) (net.Conn, error) {
+	remote, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeConn{remote: remote}, nil
+}
+
+// BenchmarkScanPorts reports the memory of scanning every port open on
+// many targets. With stageBuffer-sized channels B/op tracks the results
+// themselves; the oversized case adds the len(targets)*len(ports)*2 result
+// channel the scan used to allocate up front, for comparison.
+func BenchmarkScanPorts(b *testing.B) {
+	ports := []int{443, 2408, 500, 1701}
+	for _, n := range []int{1000, 10000} {
+		targets := make([]PingResult, n)
+		for i := range targets {
+			targets[i] = PingResult{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).String()}
+		}
+		s, err := New(Options{NoPing: true, Protocol: "tcp", Dialer: openDialer{}})
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run("targets="+strconv.Itoa(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if got := len(s.ScanPorts(context.Background(), targets, ports, nil)); got != n*len(ports) {
+					b.Fatalf("got %d results, want %d", got, n*len(ports))
+				}
+			}
+		})
+		b.Run("targets="+strconv.Itoa(n)+"/oversized", func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				oversized := make(chan EndpointResult, n*len(ports)*2)
+				for _, result := range s.ScanPorts(context.Background(), targets, ports, nil) {
+					oversized <- result
+				}
+				close(oversized)
+			}
+		})
+	}
+}
+
+func TestRetriesStopWhenBudgetSpent(t *testing.T) {
+	for _, minSuccess := range []int{1, 2} {
+		dialer := &refusingDialer{}
+		s, err := New(Options{NoPing: true, Protocol: "tcp", Retries: 5, MinSuccess: minSuccess, MaxProbes: 1, Dialer: dialer})
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		s.ScanPorts(context.Background(), []PingResult{{IP: "10.0.0.1"}}, []int{443}, nil)
+		if elapsed := time.Since(start); elapsed >= retryBackoff {
+			t.Errorf("min-success %d: scan took %v after the budget ran out, want under %v", minSuccess, elapsed, retryBackoff)
+		}
+		if got := dialer.dials.Load(); got != 1 {
+			t.Errorf("min-success %d: dials = %d, want 1", minSuccess, got)
+		}
+	}
+}
+
+// refusingDialer counts its dials and refuses them all.
+type refusingDialer struct{ dials atomic.Int64 }
+
+func (d *refusingDialer) DialContext(context.Context, string, string) (net.Conn, error) {
+	d.dials.Add(1)
+	return nil, syscall.ECONNREFUSED
+}
+
+// countingDialer counts the dials made through openDialer.
+type countingDialer struct{ dials atomic.Int64 }
+
+func (d *countingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.dials.Add(1)
+	return openDialer{}.DialContext(ctx, network, address)
+}
+
+func TestWarmupSpendsBudget(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxProbes  int
+		wantDials  int64
+		wantOpen   int
+		wantBudget bool
+	}{
+		{name: "unlimited", maxProbes: 0, wantDials: 3, wantOpen: 2},
+		{name: "warm-up and one probe", maxProbes: 2, wantDials: 2, wantOpen: 1, wantBudget: true},
+		{name: "warm-up only", maxProbes: 1, wantDials: 1, wantOpen: 0, wantBudget: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialer := &countingDialer{}
+			s, err := New(Options{NoPing: true, Protocol: "tcp", Warmup: true, MaxProbes: tt.maxProbes, Concurrency: 1, Dialer: dialer})
+			if err != nil {
+				t.Fatal(err)
+			}
+			results := s.ScanPorts(context.Background(), []PingResult{{IP: "10.0.0.1"}}, []int{80, 443}, nil)
+			if got := dialer.dials.Load(); got != tt.wantDials {
+				t.Errorf("dials = %d, want %d", got, tt.wantDials)
+			}
+			if len(results) != tt.wantOpen {
+				t.Errorf("open = %d, want %d", len(results), tt.wantOpen)
+			}
+			if s.BudgetSpent() != tt.wantBudget {
+				t.Errorf("BudgetSpent = %v, want %v", s.BudgetSpent(), tt.wantBudget)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		retry int
+		want  time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{6, 3200 * time.Millisecond},
+		{7, 5 * time.Second},
+		{100, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.retry); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.retry, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package scanner
+
+import (
+	"context"
+	"net"
+)
+
+// tunedDialer applies Options.KeepAlive, Options.Nagle and Options.Linger to
+// the TCP connections of the wrapped dialer. They are set once connected
+// rather than in a net.Dialer Control hook, because the net package resets
+// TCP_NODELAY and keep-alive after the hook runs. All three are supported
+// by the net package on every platform it builds for.
+type tunedDialer struct {
+	dialer Dialer
+	opts   Options
+}
+
+func (d tunedDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	if pc, isPortConn := conn.(*portConn); isPortConn {
+		tcp, ok = pc.Conn.(*net.TCPConn)
+	}
+	if !ok {
+		return conn, nil
+	}
+	if err := d.tune(tcp); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (d tunedDialer) tune(conn *net.TCPConn) error {
+	if d.opts.KeepAlive != 0 {
+		if err := conn.SetKeepAlive(d.opts.KeepAlive > 0); err != nil {
+			return err
+		}
+	}
+	if d.opts.KeepAlive > 0 {
+		if err := conn.SetKeepAlivePeriod(d.opts.KeepAlive); err != nil {
+			return err
+		}
+	}
+	if d.opts.Nagle {
+		if err := conn.SetNoDelay(false); err != nil {
+			return err
+		}
+	}
+	if d.opts.Linger >= 0 {
+		return conn.SetLinger(d.opts.Linger)
+	}
+	return nil
+}
+
+func (o Options) tunesSockets() bool {
+	return o.KeepAlive != 0 || o.Nagle || o.Linger >= 0
+}
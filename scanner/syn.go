@@ -0,0 +1,141 @@
+package scanner
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagACK = 0x10
+
+	ipProtocolTCP = 6
+)
+
+// errSYNUnavailable means raw TCP sockets cannot be opened, so SYN probes
+// fall back to a full connect.
+var errSYNUnavailable = errors.New("raw TCP sockets are not available")
+
+// probeTCPSYN sends a bare SYN from a raw socket and times the SYN-ACK. The
+// kernel answers the SYN-ACK with a RST, so the handshake never completes.
+// The source address is the one dialer would use to reach ip.
+func probeTCPSYN(ctx context.Context, dialer Dialer, ip string, port int, timeout time.Duration) (time.Duration, net.Addr, error) {
+	dst := net.ParseIP(ip)
+	if dst == nil {
+		return 0, nil, fmt.Errorf("invalid IP address %q", ip)
+	}
+	route, err := dialer.DialContext(ctx, dialNetwork("udp", ip), net.JoinHostPort(ip, strconv.Itoa(port)))
+	if err != nil {
+		return 0, nil, err
+	}
+	routeAddr, ok := route.LocalAddr().(*net.UDPAddr)
+	route.Close()
+	if !ok {
+		return 0, nil, fmt.Errorf("route to %s has no local UDP address", ip)
+	}
+	src := routeAddr.IP
+
+	network := "ip4:tcp"
+	if dst.To4() == nil {
+		network = "ip6:tcp"
+	} else {
+		dst, src = dst.To4(), src.To4()
+	}
+	conn, err := net.ListenPacket(network, src.String())
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %v", errSYNUnavailable, err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	srcPort := 32768 + rand.Intn(28232)
+	seq := rand.Uint32()
+	segment := buildSYN(src, dst, srcPort, port, seq)
+
+	start := time.Now()
+	if err := conn.SetDeadline(start.Add(timeout)); err != nil {
+		return 0, nil, err
+	}
+	if _, err := conn.WriteTo(segment, &net.IPAddr{IP: dst}); err != nil {
+		if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+			return 0, nil, fmt.Errorf("%w: %v", errSYNUnavailable, err)
+		}
+		return 0, nil, err
+	}
+	local := &net.TCPAddr{IP: src, Port: srcPort}
+
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, nil, ctx.Err()
+			}
+			return 0, nil, err
+		}
+		if peerAddr, ok := peer.(*net.IPAddr); !ok || !peerAddr.IP.Equal(dst) || n < 20 {
+			continue
+		}
+		reply := buf[:n]
+		if int(binary.BigEndian.Uint16(reply[0:2])) != port || int(binary.BigEndian.Uint16(reply[2:4])) != srcPort {
+			continue
+		}
+		if binary.BigEndian.Uint32(reply[8:12]) != seq+1 {
+			continue
+		}
+		flags := reply[13]
+		switch {
+		case flags&(tcpFlagSYN|tcpFlagACK) == tcpFlagSYN|tcpFlagACK:
+			return time.Since(start), local, nil
+		case flags&tcpFlagRST != 0:
+			return 0, nil, syscall.ECONNREFUSED
+		}
+	}
+}
+
+// buildSYN returns a TCP SYN segment with an MSS option, checksummed over
+// the IPv4 or IPv6 pseudo-header.
+func buildSYN(src, dst net.IP, srcPort, dstPort int, seq uint32) []byte {
+	segment := make([]byte, 24)
+	binary.BigEndian.PutUint16(segment[0:2], uint16(srcPort))
+	binary.BigEndian.PutUint16(segment[2:4], uint16(dstPort))
+	binary.BigEndian.PutUint32(segment[4:8], seq)
+	segment[12] = 6 << 4
+	segment[13] = tcpFlagSYN
+	binary.BigEndian.PutUint16(segment[14:16], 65535)
+	segment[20], segment[21] = 2, 4
+	binary.BigEndian.PutUint16(segment[22:24], 1460)
+
+	pseudo := append(append([]byte{}, src...), dst...)
+	if len(src) == net.IPv4len {
+		pseudo = append(pseudo, 0, ipProtocolTCP, 0, byte(len(segment)))
+	} else {
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(segment)))
+		pseudo = append(pseudo, 0, 0, 0, ipProtocolTCP)
+	}
+	binary.BigEndian.PutUint16(segment[16:18], checksum(append(pseudo, segment...)))
+	return segment
+}
+
+func checksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,320 @@
+package scanner
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// DefaultIPv4Subnets are the /24 subnets of DefaultPreset, as address
+// prefixes, sampled when Options.IPv4Subnets is empty.
+var DefaultIPv4Subnets = cloudflareWARP.IPv4Subnets
+
+// ParseIPv4Subnet validates a /24 given as its first three octets, e.g.
+// 162.159.192. The trailing dot is optional.
+func ParseIPv4Subnet(prefix string) (string, error) {
+	prefix = strings.TrimSpace(prefix)
+	if !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	if strings.Count(prefix, ".") != 3 {
+		return "", fmt.Errorf("invalid IPv4 subnet %q: want three octets such as 162.159.192.", prefix)
+	}
+	for _, host := range []string{"0", "255"} {
+		if ip := net.ParseIP(prefix + host); ip == nil || ip.To4() == nil {
+			return "", fmt.Errorf("invalid IPv4 subnet %q: want three octets such as 162.159.192.", prefix)
+		}
+	}
+	return prefix, nil
+}
+
+func generateIPv4Addresses(rng *rand.Rand, subnets []string, perSubnet int) ([]string, error) {
+	var ips []string
+	if perSubnet > 256 {
+		perSubnet = 256
+	}
+	for _, subnet := range subnets {
+		subnet, err := ParseIPv4Subnet(subnet)
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[int]struct{}, perSubnet)
+		for len(seen) < perSubnet {
+			host := rng.Intn(256)
+			if _, ok := seen[host]; ok {
+				continue
+			}
+			seen[host] = struct{}{}
+			ips = append(ips, fmt.Sprintf("%s%d", subnet, host))
+		}
+	}
+	return ips, nil
+}
+
+// DefaultIPv6Prefixes are the prefixes of DefaultPreset sampled when
+// Options.IPv6Prefixes is empty.
+var DefaultIPv6Prefixes = cloudflareWARP.IPv6Prefixes
+
+// ParseIPv6Prefix validates an IPv6 CIDR block. A bare address is taken as
+// a /64, so only the interface identifier is randomized.
+func ParseIPv6Prefix(prefix string) (string, error) {
+	prefix = strings.TrimSpace(prefix)
+	if ip := net.ParseIP(prefix); ip != nil && ip.To4() == nil {
+		return prefix + "/64", nil
+	}
+	ip, network, err := net.ParseCIDR(prefix)
+	if err != nil || ip.To4() != nil {
+		return "", fmt.Errorf("invalid IPv6 prefix %q", prefix)
+	}
+	return network.String(), nil
+}
+
+// generateIPv6Addresses samples perPrefix random addresses from each
+// prefix, randomizing only the bits below its prefix length.
+func generateIPv6Addresses(rng *rand.Rand, prefixes []string, perPrefix int) ([]string, error) {
+	var ips []string
+	for _, prefix := range prefixes {
+		cidr, err := ParseIPv6Prefix(prefix)
+		if err != nil {
+			return nil, err
+		}
+		expanded, err := expandCIDR(rng, cidr, perPrefix)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, expanded...)
+	}
+	return ips, nil
+}
+
+func expandCIDR(rng *rand.Rand, cidr string, sample int) ([]string, error) {
+	_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+	if err != nil {
+		return nil, err
+	}
+	base := network.IP.To4()
+	if base == nil {
+		base = network.IP.To16()
+	}
+	ones, bits := network.Mask.Size()
+	hostBits := bits - ones
+
+	var ips []string
+	if hostBits < 31 && 1<<hostBits <= sample {
+		ip := make(net.IP, len(base))
+		copy(ip, base)
+		for i := 0; i < 1<<hostBits; i++ {
+			ips = append(ips, ip.String())
+			for j := len(ip) - 1; j >= 0; j-- {
+				ip[j]++
+				if ip[j] != 0 {
+					break
+				}
+			}
+		}
+		return ips, nil
+	}
+
+	for i := 0; i < sample; i++ {
+		ip := make(net.IP, len(base))
+		for j := range ip {
+			ip[j] = base[j] | byte(rng.Intn(256))&^network.Mask[j]
+		}
+		ips = append(ips, ip.String())
+	}
+	return ips, nil
+}
+
+func dedupeIPs(ips []string) []string {
+	seen := make(map[string]struct{}, len(ips))
+	unique := ips[:0]
+	for _, ip := range ips {
+		if _, ok := seen[ip]; ok {
+			continue
+		}
+		seen[ip] = struct{}{}
+		unique = append(unique, ip)
+	}
+	return unique
+}
+
+// GenerateTargets builds the candidate IP list from opts.CIDRs, or from
+// opts.IPv4Subnets and opts.IPv6Prefixes when no CIDRs are given. IPv4
+// addresses come first and duplicates are removed.
+func GenerateTargets(opts Options) ([]string, error) {
+	opts = opts.withDefaults()
+	if len(opts.CIDRs) == 0 {
+		v4, err := generateIPv4Addresses(opts.Rand, opts.IPv4Subnets, opts.IPsPerSubnet)
+		if err != nil {
+			return nil, err
+		}
+		v6, err := generateIPv6Addresses(opts.Rand, opts.IPv6Prefixes, opts.IPsPerSubnet)
+		if err != nil {
+			return nil, err
+		}
+		return dedupeIPs(append(v4, v6...)), nil
+	}
+
+	var ips []string
+	for _, cidr := range opts.CIDRs {
+		expanded, err := expandCIDR(opts.Rand, cidr, opts.IPsPerSubnet)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, expanded...)
+	}
+	v4, v6 := SplitByFamily(ips)
+	return dedupeIPs(append(v4, v6...)), nil
+}
+
+// ParseExclusions parses a comma-separated list of IPs and CIDR blocks.
+func ParseExclusions(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if ip := net.ParseIP(field); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP or CIDR %q", field)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// ExcludeTargets returns the IPs not covered by any of excluded.
+func ExcludeTargets(ips []string, excluded []*net.IPNet) []string {
+	var kept []string
+	for _, ip := range ips {
+		addr := net.ParseIP(ip)
+		if !slices.ContainsFunc(excluded, func(network *net.IPNet) bool { return network.Contains(addr) }) {
+			kept = append(kept, ip)
+		}
+	}
+	return kept
+}
+
+// SplitByFamily separates IPv4 from IPv6 addresses, keeping their order.
+func SplitByFamily(ips []string) (v4, v6 []string) {
+	for _, ip := range ips {
+		if strings.Contains(ip, ":") {
+			v6 = append(v6, ip)
+		} else {
+			v4 = append(v4, ip)
+		}
+	}
+	return v4, v6
+}
+
+// lookupIP resolves hostnames in target files. Tests may replace it.
+var lookupIP = net.LookupIP
+
+// TargetFile is the content of a target list read by LoadTargets.
+type TargetFile struct {
+	IPs []string
+	// Ports and Hostnames are keyed by IP, for Options.TargetPorts and
+	// Options.TargetHosts.
+	Ports     map[string][]int
+	Hostnames map[string]string
+}
+
+// LoadTargets reads one IP, hostname, ip:port or hostname:port per line,
+// skipping blank lines and # comments. Hostnames are expanded to all of
+// their A and AAAA records. Malformed or unresolvable lines are reported
+// with their line number.
+func LoadTargets(r io.Reader) (TargetFile, error) {
+	targets := TargetFile{Ports: make(map[string][]int), Hostnames: make(map[string]string)}
+	seen := make(map[string]struct{})
+	resolved := make(map[string][]net.IP)
+	var problems []string
+
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		host, port := line, 0
+		if net.ParseIP(line) == nil {
+			h, p, err := net.SplitHostPort(line)
+			switch {
+			case err == nil:
+				n, err := strconv.Atoi(p)
+				if err != nil || n < 1 || n > 65535 {
+					problems = append(problems, fmt.Sprintf("line %d: invalid port in %q", lineNo, line))
+					continue
+				}
+				host, port = h, n
+			case strings.Contains(line, ":"):
+				problems = append(problems, fmt.Sprintf("line %d: invalid target %q", lineNo, line))
+				continue
+			}
+		}
+
+		var ips []net.IP
+		hostname := ""
+		if ip := net.ParseIP(host); ip != nil {
+			ips = []net.IP{ip}
+		} else {
+			if _, ok := resolved[host]; !ok {
+				addrs, err := lookupIP(host)
+				if err != nil {
+					problems = append(problems, fmt.Sprintf("line %d: could not resolve %q: %v", lineNo, host, err))
+					continue
+				}
+				resolved[host] = addrs
+			}
+			ips, hostname = resolved[host], host
+		}
+
+		for _, ip := range ips {
+			addr := ip.String()
+			if _, ok := seen[addr]; !ok {
+				seen[addr] = struct{}{}
+				targets.IPs = append(targets.IPs, addr)
+			}
+			if port != 0 {
+				targets.Ports[addr] = append(targets.Ports[addr], port)
+			}
+			if _, ok := targets.Hostnames[addr]; hostname != "" && !ok {
+				targets.Hostnames[addr] = hostname
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return TargetFile{}, err
+	}
+	if len(problems) > 0 {
+		return TargetFile{}, errors.New(strings.Join(problems, "\n"))
+	}
+	return targets, nil
+}
+
+// HasIPv6 reports whether the host has a global IPv6 route. No packets are
+// sent; the UDP dial only asks the kernel for a source address.
+func HasIPv6() bool {
+	conn, err := net.Dial("udp6", "[2606:4700:4700::1111]:53")
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	return ok && addr.IP.IsGlobalUnicast()
+}
@@ -0,0 +1,76 @@
+package scanner
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadTargets(t *testing.T) {
+	defer func(orig func(string) ([]net.IP, error)) { lookupIP = orig }(lookupIP)
+	lookupIP = func(host string) ([]net.IP, error) {
+		if host == "engage.cloudflareclient.com" {
+			return []net.IP{net.ParseIP("162.159.192.1"), net.ParseIP("2606:4700:d0::a29f:c001")}, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+
+	tests := []struct {
+		name    string
+		input   string
+		want    TargetFile
+		wantErr string
+	}{
+		{
+			name:  "ips, comments and blank lines",
+			input: "# candidates\n162.159.192.1\n\n  162.159.195.7  \n2606:4700:d0::1\n162.159.192.1\n",
+			want: TargetFile{
+				IPs:       []string{"162.159.192.1", "162.159.195.7", "2606:4700:d0::1"},
+				Ports:     map[string][]int{},
+				Hostnames: map[string]string{},
+			},
+		},
+		{
+			name:  "ports",
+			input: "162.159.192.1:2408\n162.159.192.1:500\n[2606:4700:d0::1]:443\n",
+			want: TargetFile{
+				IPs:       []string{"162.159.192.1", "2606:4700:d0::1"},
+				Ports:     map[string][]int{"162.159.192.1": {2408, 500}, "2606:4700:d0::1": {443}},
+				Hostnames: map[string]string{},
+			},
+		},
+		{
+			name:  "hostname expands to every address",
+			input: "engage.cloudflareclient.com:2408\n",
+			want: TargetFile{
+				IPs:       []string{"162.159.192.1", "2606:4700:d0::a29f:c001"},
+				Ports:     map[string][]int{"162.159.192.1": {2408}, "2606:4700:d0::a29f:c001": {2408}},
+				Hostnames: map[string]string{"162.159.192.1": "engage.cloudflareclient.com", "2606:4700:d0::a29f:c001": "engage.cloudflareclient.com"},
+			},
+		},
+		{
+			name:    "malformed lines report their line numbers",
+			input:   "162.159.192.1\n162.159.192.1:0\n1:2:3\nnowhere.invalid\n",
+			wantErr: "line 2: invalid port in \"162.159.192.1:0\"\nline 3: invalid target \"1:2:3\"\nline 4: could not resolve \"nowhere.invalid\": no such host",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := LoadTargets(strings.NewReader(tt.input))
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LoadTargets = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+//go:build linux
+
+package scanner
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const tcpInfoSupported = true
+
+// readTCPInfo returns the kernel's smoothed RTT and send MSS for conn from
+// TCP_INFO.
+func readTCPInfo(conn *net.TCPConn) (time.Duration, int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	var info *unix.TCPInfo
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		info, sockErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if sockErr != nil {
+		return 0, 0, sockErr
+	}
+	return time.Duration(info.Rtt) * time.Microsecond, int(info.Snd_mss), nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package scanner
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+const tcpInfoSupported = false
+
+func readTCPInfo(*net.TCPConn) (time.Duration, int, error) {
+	return 0, 0, errors.New("TCP_INFO is only available on Linux")
+}
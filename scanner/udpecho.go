@@ -0,0 +1,70 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	udpEchoPayloadSize = 16
+
+	// MaxUDPPayload is the largest UDP payload that fits an IPv4 packet on
+	// a 1500-byte MTU link without fragmenting, and MaxUDPDatagram the
+	// largest one IPv4 allows at all.
+	MaxUDPPayload  = 1472
+	MaxUDPDatagram = 65507
+)
+
+// udpPayload returns the datagram for an echo or icmp UDP probe, of
+// Options.UDPPayloadSize bytes or else size.
+func (s *Scanner) udpPayload(size int, random bool) []byte {
+	if s.opts.UDPPayloadSize > 0 {
+		size = s.opts.UDPPayloadSize
+	}
+	payload := make([]byte, size)
+	if fill := s.opts.UDPPayloadFill; len(fill) > 0 {
+		for i := range payload {
+			payload[i] = fill[i%len(fill)]
+		}
+	} else if random {
+		rand.Read(payload)
+	}
+	return payload
+}
+
+// probeUDPEcho sends payload and waits for the same bytes to come back,
+// returning the round trip.
+func probeUDPEcho(ctx context.Context, dialer Dialer, ip string, port int, timeout time.Duration, payload []byte) (time.Duration, net.Addr, bool) {
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	conn, err := dialer.DialContext(dialCtx, dialNetwork("udp", ip), net.JoinHostPort(ip, strconv.Itoa(port)))
+	cancel()
+	if err != nil {
+		return 0, nil, false
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	start := time.Now()
+	if err := conn.SetDeadline(start.Add(timeout)); err != nil {
+		return 0, nil, false
+	}
+	if _, err := conn.Write(payload); err != nil {
+		return 0, nil, false
+	}
+
+	buf := make([]byte, max(len(payload)+1, 512))
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return 0, nil, false
+		}
+		if bytes.Equal(buf[:n], payload) {
+			return time.Since(start), conn.LocalAddr(), true
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package scanner
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var errPortUnreachable = errors.New("ICMP port unreachable")
+
+const ipProtocolUDP = 17
+
+// StateOpenFiltered is the EndpointResult.State of a UDP port probed in
+// icmp mode that neither answered nor sent an ICMP port unreachable. Its
+// Latency stays zero, since nothing was timed.
+const StateOpenFiltered = "open|filtered"
+
+// probeUDPICMP sends payload and waits for an ICMP port unreachable, which
+// marks the port closed, or an answer from the port, which it times.
+// Silence until timeout means open|filtered, reported with answered false
+// and no latency. Without raw sockets the ICMP error is read back as
+// ECONNREFUSED on the connected UDP socket instead.
+func probeUDPICMP(ctx context.Context, dialer Dialer, ip string, port int, timeout time.Duration, payload []byte) (time.Duration, net.Addr, bool, error) {
+	dst := net.ParseIP(ip)
+	if dst == nil {
+		return 0, nil, false, errors.New("invalid IP address")
+	}
+	network, listenAddr, protocol := "ip4:icmp", "0.0.0.0", 1
+	if dst.To4() == nil {
+		network, listenAddr, protocol = "ip6:ipv6-icmp", "::", 58
+	}
+	listener, err := icmp.ListenPacket(network, listenAddr)
+	if err != nil && !errors.Is(err, os.ErrPermission) {
+		return 0, nil, false, err
+	}
+	if listener != nil {
+		defer listener.Close()
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	conn, err := dialer.DialContext(dialCtx, dialNetwork("udp", ip), net.JoinHostPort(ip, strconv.Itoa(port)))
+	cancel()
+	if err != nil {
+		return 0, nil, false, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+		if listener != nil {
+			listener.SetDeadline(time.Now())
+		}
+	})
+	defer stop()
+
+	start := time.Now()
+	if err := conn.SetDeadline(start.Add(timeout)); err != nil {
+		return 0, nil, false, err
+	}
+	if _, err := conn.Write(payload); err != nil {
+		return 0, nil, false, err
+	}
+	local, _ := conn.LocalAddr().(*net.UDPAddr)
+	if local == nil {
+		return 0, nil, false, errors.New("UDP probe without a local UDP address")
+	}
+
+	if listener == nil {
+		_, err := conn.Read(make([]byte, 1500))
+		var netErr net.Error
+		switch {
+		case err == nil:
+			return time.Since(start), local, true, nil
+		case ctx.Err() != nil:
+			return 0, nil, false, ctx.Err()
+		case errors.Is(err, syscall.ECONNREFUSED):
+			return 0, local, false, errPortUnreachable
+		case errors.As(err, &netErr) && netErr.Timeout():
+			return 0, local, false, nil
+		}
+		return 0, nil, false, err
+	}
+
+	if err := listener.SetReadDeadline(start.Add(timeout)); err != nil {
+		return 0, nil, false, err
+	}
+	// An answer from the port itself arrives on conn, not the listener.
+	replied := make(chan time.Duration, 1)
+	go func() {
+		if _, err := conn.Read(make([]byte, 1500)); err == nil {
+			replied <- time.Since(start)
+			listener.SetReadDeadline(time.Now())
+		}
+	}()
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := listener.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if ctx.Err() != nil {
+				return 0, nil, false, ctx.Err()
+			}
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				select {
+				case latency := <-replied:
+					return latency, local, true, nil
+				default:
+					return 0, local, false, nil
+				}
+			}
+			return 0, nil, false, err
+		}
+		if isPortUnreachable(protocol, buf[:n], dst, local.Port, port) {
+			return 0, local, false, errPortUnreachable
+		}
+	}
+}
+
+// isPortUnreachable reports whether packet is an ICMP port unreachable for
+// the datagram sent from srcPort to dst:dstPort.
+func isPortUnreachable(protocol int, packet []byte, dst net.IP, srcPort, dstPort int) bool {
+	msg, err := icmp.ParseMessage(protocol, packet)
+	if err != nil {
+		return false
+	}
+	body, ok := msg.Body.(*icmp.DstUnreach)
+	if !ok {
+		return false
+	}
+	orig := body.Data
+
+	var udp []byte
+	if protocol == 1 {
+		if msg.Type != ipv4.ICMPTypeDestinationUnreachable || msg.Code != 3 || len(orig) < 20 {
+			return false
+		}
+		headerLen := int(orig[0]&0x0f) * 4
+		if orig[9] != ipProtocolUDP || len(orig) < headerLen+4 || !net.IP(orig[16:20]).Equal(dst) {
+			return false
+		}
+		udp = orig[headerLen:]
+	} else {
+		if msg.Type != ipv6.ICMPTypeDestinationUnreachable || msg.Code != 4 || len(orig) < 44 {
+			return false
+		}
+		if orig[6] != ipProtocolUDP || !net.IP(orig[24:40]).Equal(dst) {
+			return false
+		}
+		udp = orig[40:]
+	}
+	return int(binary.BigEndian.Uint16(udp[0:2])) == srcPort && int(binary.BigEndian.Uint16(udp[2:4])) == dstPort
+}
@@ -0,0 +1,179 @@
+package scanner
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"hash"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	wgConstruction = "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"
+	wgIdentifier   = "WireGuard v1 zx2c4 Jason@zx2c4.com"
+	wgLabelMAC1    = "mac1----"
+
+	wgInitiationSize = 148
+	wgResponseSize   = 92
+
+	// WARPPublicKey is the WireGuard public key of Cloudflare WARP peers.
+	WARPPublicKey = "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo="
+)
+
+func warpPublicKeyBytes() []byte {
+	key, _ := base64.StdEncoding.DecodeString(WARPPublicKey)
+	return key
+}
+
+func wgHash(parts ...[]byte) []byte {
+	h, _ := blake2s.New256(nil)
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+func wgHMAC(key []byte, parts ...[]byte) []byte {
+	mac := hmac.New(func() hash.Hash {
+		h, _ := blake2s.New256(nil)
+		return h
+	}, key)
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
+
+func wgKDF2(chainKey, input []byte) ([]byte, []byte) {
+	prk := wgHMAC(chainKey, input)
+	t1 := wgHMAC(prk, []byte{0x1})
+	t2 := wgHMAC(prk, t1, []byte{0x2})
+	return t1, t2
+}
+
+func wgSeal(key, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	return aead.Seal(nil, nonce, plaintext, additionalData), nil
+}
+
+func tai64n(t time.Time) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint64(b, 0x400000000000000a+uint64(t.Unix()))
+	binary.BigEndian.PutUint32(b[8:], uint32(t.Nanosecond()))
+	return b
+}
+
+// buildWireGuardInitiation builds a handshake initiation from a throwaway
+// static key. The responder only answers if mac1 and the encrypted fields
+// check out against its public key, so a reply proves a WireGuard peer.
+func buildWireGuardInitiation(peerPublicKey []byte) ([]byte, uint32, error) {
+	curve := ecdh.X25519()
+	peer, err := curve.NewPublicKey(peerPublicKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	static, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, 0, err
+	}
+	ephemeral, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	msg := make([]byte, wgInitiationSize)
+	msg[0] = 1
+	if _, err := rand.Read(msg[4:8]); err != nil {
+		return nil, 0, err
+	}
+	senderIndex := binary.LittleEndian.Uint32(msg[4:8])
+
+	chainKey := wgHash([]byte(wgConstruction))
+	h := wgHash(chainKey, []byte(wgIdentifier))
+	h = wgHash(h, peerPublicKey)
+
+	ephemeralPublic := ephemeral.PublicKey().Bytes()
+	copy(msg[8:40], ephemeralPublic)
+	chainKey = wgHMAC(wgHMAC(chainKey, ephemeralPublic), []byte{0x1})
+	h = wgHash(h, ephemeralPublic)
+
+	shared, err := ephemeral.ECDH(peer)
+	if err != nil {
+		return nil, 0, err
+	}
+	chainKey, key := wgKDF2(chainKey, shared)
+	encryptedStatic, err := wgSeal(key, static.PublicKey().Bytes(), h)
+	if err != nil {
+		return nil, 0, err
+	}
+	copy(msg[40:88], encryptedStatic)
+	h = wgHash(h, encryptedStatic)
+
+	shared, err = static.ECDH(peer)
+	if err != nil {
+		return nil, 0, err
+	}
+	_, key = wgKDF2(chainKey, shared)
+	encryptedTimestamp, err := wgSeal(key, tai64n(time.Now()), h)
+	if err != nil {
+		return nil, 0, err
+	}
+	copy(msg[88:116], encryptedTimestamp)
+
+	mac1, err := blake2s.New128(wgHash([]byte(wgLabelMAC1), peerPublicKey))
+	if err != nil {
+		return nil, 0, err
+	}
+	mac1.Write(msg[:116])
+	copy(msg[116:132], mac1.Sum(nil))
+
+	return msg, senderIndex, nil
+}
+
+func probeUDPWireGuard(ctx context.Context, dialer Dialer, ip string, port int, timeout time.Duration, peerPublicKey []byte) (time.Duration, net.Addr, bool) {
+	packet, senderIndex, err := buildWireGuardInitiation(peerPublicKey)
+	if err != nil {
+		return 0, nil, false
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	conn, err := dialer.DialContext(dialCtx, dialNetwork("udp", ip), net.JoinHostPort(ip, strconv.Itoa(port)))
+	cancel()
+	if err != nil {
+		return 0, nil, false
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	start := time.Now()
+	if err := conn.SetDeadline(start.Add(timeout)); err != nil {
+		return 0, nil, false
+	}
+	if _, err := conn.Write(packet); err != nil {
+		return 0, nil, false
+	}
+
+	buf := make([]byte, 512)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return 0, nil, false
+		}
+		if n == wgResponseSize && buf[0] == 2 && binary.LittleEndian.Uint32(buf[8:12]) == senderIndex {
+			return time.Since(start), conn.LocalAddr(), true
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/monsmain/endpoint-scanner/scanner"
+)
+
+// selfTestMaxLatency is the slowest loopback probe -self-test accepts.
+const selfTestMaxLatency = 100 * time.Millisecond
+
+// runSelfTest scans TCP and UDP echo listeners on ephemeral loopback ports
+// and prints PASS or FAIL for each protocol. It returns 0 only if both
+// endpoints were found with a latency under selfTestMaxLatency.
+func runSelfTest(ctx context.Context, logger *slog.Logger) int {
+	tcpListener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println("FAIL: could not listen on TCP:", err)
+		return 1
+	}
+	defer tcpListener.Close()
+	go func() {
+		for {
+			conn, err := tcpListener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	udpConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println("FAIL: could not listen on UDP:", err)
+		return 1
+	}
+	defer udpConn.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := udpConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udpConn.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	endpoints := map[string]string{
+		"tcp": tcpListener.Addr().String(),
+		"udp": udpConn.LocalAddr().String(),
+	}
+	s, err := scanner.New(scanner.Options{
+		TCPPorts:   []int{tcpListener.Addr().(*net.TCPAddr).Port},
+		UDPPorts:   []int{udpConn.LocalAddr().(*net.UDPAddr).Port},
+		TCPTimeout: time.Second,
+		UDPTimeout: time.Second,
+		UDPMode:    "echo",
+		NoPing:     true,
+		Logger:     logger,
+	})
+	if err != nil {
+		fmt.Println("FAIL:", err)
+		return 1
+	}
+
+	found := make(map[string]scanner.EndpointResult)
+	for result := range s.Pipeline(ctx, []string{"127.0.0.1"}) {
+		found[result.Protocol] = result
+	}
+	code := 0
+	for _, protocol := range []string{"tcp", "udp"} {
+		result, ok := found[protocol]
+		switch {
+		case !ok:
+			fmt.Printf("FAIL: %s %s was not found\n", protocol, endpoints[protocol])
+			code = 1
+		case result.Latency <= 0 || result.Latency > selfTestMaxLatency:
+			fmt.Printf("FAIL: %s %s latency %.2f ms is outside (0, %s]\n", protocol, result.Endpoint, millis(result.Latency), selfTestMaxLatency)
+			code = 1
+		default:
+			fmt.Printf("PASS: %s %s found (Latency: %.2f ms)\n", protocol, result.Endpoint, millis(result.Latency))
+		}
+	}
+	return code
+}
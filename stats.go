@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/monsmain/endpoint-scanner/scanner"
+)
+
+const (
+	histogramBuckets = 10
+	histogramWidth   = 40
+)
+
+func sortedRTTs(pings []scanner.PingResult) []time.Duration {
+	rtts := make([]time.Duration, len(pings))
+	for i, ping := range pings {
+		rtts[i] = ping.RTT
+	}
+	slices.Sort(rtts)
+	return rtts
+}
+
+// percentile returns the nearest-rank p-th percentile of sorted rtts.
+func percentile(rtts []time.Duration, p float64) time.Duration {
+	if len(rtts) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(rtts))))
+	return rtts[max(rank-1, 0)]
+}
+
+func rttPercentiles(pings []scanner.PingResult) (p50, p90, p99 time.Duration) {
+	rtts := sortedRTTs(pings)
+	return percentile(rtts, 50), percentile(rtts, 90), percentile(rtts, 99)
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Nanoseconds()) / 1e6
+}
+
+// printPingStats prints the RTT percentiles of every IP that answered ping
+// and a histogram over equal-width RTT buckets.
+func printPingStats(pings []scanner.PingResult) {
+	fmt.Println("\n--- Ping RTT Stats ---")
+	if len(pings) == 0 {
+		fmt.Println("No IP answered ping.")
+		return
+	}
+	rtts := sortedRTTs(pings)
+	p50, p90, p99 := rttPercentiles(pings)
+	low, high := rtts[0], rtts[len(rtts)-1]
+	fmt.Printf("%d IPs  min %.2f ms  p50 %.2f ms  p90 %.2f ms  p99 %.2f ms  max %.2f ms\n",
+		len(rtts), millis(low), millis(p50), millis(p90), millis(p99), millis(high))
+
+	counts := make([]int, histogramBuckets)
+	width := (high - low) / histogramBuckets
+	for _, rtt := range rtts {
+		bucket := histogramBuckets - 1
+		if width > 0 {
+			bucket = min(int((rtt-low)/width), histogramBuckets-1)
+		}
+		counts[bucket]++
+	}
+	peak := slices.Max(counts)
+	for i, count := range counts {
+		if width == 0 && count == 0 {
+			continue
+		}
+		from := low + time.Duration(i)*width
+		bar := strings.Repeat("#", (count*histogramWidth+peak-1)/peak)
+		fmt.Printf("%8.2f - %8.2f ms | %-*s %d\n", millis(from), millis(from+width), histogramWidth, bar, count)
+	}
+}
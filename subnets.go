@@ -0,0 +1,84 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/monsmain/endpoint-scanner/scanner"
+)
+
+type subnetRank struct {
+	cidr    string
+	sampled int
+	pings   []scanner.PingResult
+	median  time.Duration
+}
+
+// subnetCIDRs lists the blocks a scan with opts would sample from: its
+// CIDRs, or else its IPv4 /24s and IPv6 prefixes.
+func subnetCIDRs(opts scanner.Options, includeV6 bool) []string {
+	cidrs := opts.CIDRs
+	if len(cidrs) == 0 {
+		for _, subnet := range opts.IPv4Subnets {
+			cidrs = append(cidrs, subnet+"0/24")
+		}
+		cidrs = append(cidrs, opts.IPv6Prefixes...)
+	}
+	if includeV6 {
+		return cidrs
+	}
+	return slices.DeleteFunc(slices.Clone(cidrs), func(cidr string) bool { return strings.Contains(cidr, ":") })
+}
+
+// sampleSubnets pings n random IPs of every block in cidrs and ranks the
+// blocks by median RTT, blocks without any reply last.
+func sampleSubnets(ctx context.Context, s *scanner.Scanner, opts scanner.Options, cidrs []string, n int, excluded []*net.IPNet) ([]subnetRank, error) {
+	ranks := make([]subnetRank, len(cidrs))
+	owner := make(map[string]int)
+	var ips []string
+	for i, cidr := range cidrs {
+		sample, err := scanner.GenerateTargets(scanner.Options{CIDRs: []string{cidr}, IPsPerSubnet: n, Rand: opts.Rand})
+		if err != nil {
+			return nil, err
+		}
+		ranks[i].cidr = cidr
+		for _, ip := range scanner.ExcludeTargets(sample, excluded) {
+			if _, ok := owner[ip]; !ok {
+				owner[ip] = i
+				ips = append(ips, ip)
+				ranks[i].sampled++
+			}
+		}
+	}
+
+	for _, ping := range s.PingAll(ctx, ips) {
+		rank := &ranks[owner[ping.IP]]
+		rank.pings = append(rank.pings, ping)
+	}
+	for i := range ranks {
+		ranks[i].median = percentile(sortedRTTs(ranks[i].pings), 50)
+	}
+	slices.SortStableFunc(ranks, func(a, b subnetRank) int {
+		if (len(a.pings) == 0) != (len(b.pings) == 0) {
+			return cmp.Compare(len(b.pings), len(a.pings))
+		}
+		return cmp.Compare(a.median, b.median)
+	})
+	return ranks, nil
+}
+
+func printSubnetRanking(ranks []subnetRank) {
+	fmt.Println("\n--- Subnets by Median Ping ---")
+	for i, rank := range ranks {
+		if len(rank.pings) == 0 {
+			fmt.Printf("%d. %s (no reply from %d sampled IPs)\n", i+1, rank.cidr, rank.sampled)
+			continue
+		}
+		fmt.Printf("%d. %s (Median Ping: %.2f ms, %d/%d sampled IPs answered)\n", i+1, rank.cidr, millis(rank.median), len(rank.pings), rank.sampled)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/monsmain/endpoint-scanner/scanner"
+)
+
+// watch re-runs the scan every interval until ctx is cancelled, printing a
+// timestamped best endpoint per protocol and flagging when it changes. A
+// non-zero budget bounds each cycle like -duration does for a single run.
+// With stream set, every open endpoint is written as NDJSON instead,
+// followed by a "removed" line for each one the previous cycle found but
+// this one did not. A non-nil metrics is updated after every cycle, and a
+// non-nil blacklist drops flaky endpoints from both.
+func watch(ctx context.Context, opts scanner.Options, interval, budget time.Duration, stream bool, metrics *watchMetrics, bl *blacklist, targets func() []string) {
+	enc := json.NewEncoder(os.Stdout)
+	banner := os.Stdout
+	if stream {
+		banner = os.Stderr
+	}
+	fmt.Fprintf(banner, "Watching for the best endpoints every %s (Ctrl-C to stop)...\n", interval)
+
+	lastBest := make(map[string]string)
+	protocols := []string{"tcp", "udp"}
+	if opts.Protocol != "" {
+		protocols = []string{opts.Protocol}
+	}
+	if bl != nil {
+		opts.OnFailure = bl.failed
+	}
+	listed := bl.listed()
+	var previous map[string]scanner.EndpointResult
+	for cycle := 1; ; cycle++ {
+		cycleCtx, cancel := ctx, context.CancelFunc(func() {})
+		if budget > 0 {
+			cycleCtx, cancel = context.WithTimeout(ctx, budget)
+		}
+		s, err := scanner.New(opts)
+		if err != nil {
+			cancel()
+			fmt.Fprintln(os.Stderr, "Invalid options:", err)
+			return
+		}
+		byProto := make(map[string][]scanner.EndpointResult)
+		current := make(map[string]scanner.EndpointResult)
+		for result := range s.Pipeline(cycleCtx, targets()) {
+			if !bl.admit(result) {
+				continue
+			}
+			if stream {
+				if err := writeJSONLine(enc, result, "open", cycle); err != nil {
+					opts.Logger.Error("could not write JSON", "err", err)
+				}
+			}
+			byProto[result.Protocol] = append(byProto[result.Protocol], result)
+			current[endpointKey(result.Target, result.Protocol)] = result
+		}
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if stream {
+			for _, key := range slices.Sorted(maps.Keys(previous)) {
+				if _, ok := current[key]; ok {
+					continue
+				}
+				if err := writeJSONLine(enc, previous[key], "removed", cycle); err != nil {
+					opts.Logger.Error("could not write JSON", "err", err)
+				}
+			}
+		}
+		previous = current
+
+		for _, results := range byProto {
+			s.SortResults(results)
+		}
+		metrics.update(byProto, s.ResponsiveIPs())
+		if !stream {
+			printWinners(protocols, byProto, lastBest)
+		}
+		if bl != nil {
+			now := bl.listed()
+			for _, key := range now {
+				if !slices.Contains(listed, key) {
+					fmt.Fprintf(banner, "[%s] Blacklisted %s after more than %d failures\n", time.Now().Format(time.RFC3339), key, bl.threshold)
+				}
+			}
+			listed = now
+			if err := bl.save(); err != nil {
+				opts.Logger.Error("could not write cache", "path", bl.path, "err", err)
+			}
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// printWinners prints one timestamped best-endpoint line per protocol and
+// records the winners in lastBest for the next cycle. byProto must already
+// be sorted best first. Open|filtered ports never win.
+func printWinners(protocols []string, byProto map[string][]scanner.EndpointResult, lastBest map[string]string) {
+	timestamp := time.Now().Format(time.RFC3339)
+	for _, protocol := range protocols {
+		results := answered(byProto[protocol])
+		if len(results) == 0 {
+			fmt.Printf("[%s] %s best: none\n", timestamp, protocolLabel(protocol))
+			continue
+		}
+		best := results[0]
+		line := fmt.Sprintf("[%s] %s best: %s (Latency: %.2f ms, Real Ping: %s)",
+			timestamp, protocolLabel(protocol), best.Endpoint, float64(best.Latency.Nanoseconds())/1e6, formatPing(best.Ping))
+		if previous, ok := lastBest[protocol]; ok && previous != best.Endpoint {
+			line += fmt.Sprintf("  <- new winner, was %s", previous)
+		}
+		lastBest[protocol] = best.Endpoint
+		fmt.Println(line)
+	}
+}
+
+func protocolLabel(protocol string) string {
+	if protocol == "tcp" {
+		return "TCP"
+	}
+	return "UDP"
+}